@@ -1,6 +1,8 @@
 package brotli_hz
 
 import (
+	"errors"
+	"fmt"
 	"github.com/andybalholm/brotli"
 	"github.com/cloudwego/hertz/pkg/app"
 	"github.com/cloudwego/hertz/pkg/app/client"
@@ -12,14 +14,171 @@ const (
 	DefaultCompression = brotli.DefaultCompression
 )
 
+// Preset bundles encoder settings and content rules for a typical workload,
+// apply it with WithPreset or WithClientPreset.
+type Preset struct {
+	Level        int
+	LGWin        int
+	MinLength    int
+	ContentTypes []string
+}
+
+var (
+	// PresetRealtime favors latency, for dynamic API responses.
+	PresetRealtime = Preset{
+		Level:        4,
+		LGWin:        18,
+		MinLength:    256,
+		ContentTypes: []string{"text/*", "application/json", "application/x-ndjson", "application/javascript", "application/xml"},
+	}
+	// PresetBalanced is a reasonable default for mixed traffic.
+	PresetBalanced = Preset{
+		Level:        DefaultCompression,
+		LGWin:        20,
+		MinLength:    512,
+		ContentTypes: []string{"text/*", "application/json", "application/x-ndjson", "application/javascript", "application/xml", "image/svg+xml"},
+	}
+	// PresetStatic favors ratio, for assets that are compressed once and cached.
+	PresetStatic = Preset{
+		Level:        BestCompression,
+		LGWin:        24,
+		MinLength:    1024,
+		ContentTypes: []string{"text/*", "application/json", "application/javascript", "application/xml", "application/wasm", "image/svg+xml", "font/ttf", "font/otf"},
+	}
+)
+
+// Brotli panics if the configuration is invalid, use NewBrotli to handle the error.
 func Brotli(level int, opts ...Option) app.HandlerFunc {
-	return newBrotliSrvMiddleware(level, opts...).Handle
+	return must(NewBrotli(level, opts...))
 }
 
+func NewBrotli(level int, opts ...Option) (app.HandlerFunc, error) {
+	bs, err := newBrotliSrvMiddleware(level, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return bs.Handle, nil
+}
+
+// BrotliStream panics if the configuration is invalid, use NewBrotliStream to
+// handle the error. It streams over HTTP/1.x and over servers which install a
+// hijack writer, for other protocols it compresses like Brotli.
 func BrotliStream(level int, opts ...Option) app.HandlerFunc {
-	return newBrotliSrvMiddleware(level, opts...).StreamHandle
+	return must(NewBrotliStream(level, opts...))
+}
+
+func NewBrotliStream(level int, opts ...Option) (app.HandlerFunc, error) {
+	bs, err := newBrotliSrvMiddleware(level, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return bs.StreamHandle, nil
 }
 
+// BrotliAuto buffers the response and compresses it like Brotli, unless the
+// handler flushes or writes more than the buffer size (see WithBufferSize),
+// in which case it switches to chunked compression like BrotliStream.
+// It panics if the configuration is invalid, use NewBrotliAuto to handle the error.
+func BrotliAuto(level int, opts ...Option) app.HandlerFunc {
+	return must(NewBrotliAuto(level, opts...))
+}
+
+func NewBrotliAuto(level int, opts ...Option) (app.HandlerFunc, error) {
+	bs, err := newBrotliSrvMiddleware(level, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return bs.AutoHandle, nil
+}
+
+// BrotliClient panics if the configuration is invalid, use NewBrotliClient to
+// handle the error.
 func BrotliClient(level int, opts ...ClientOption) client.Middleware {
-	return newBrotliCliMiddleware(level, opts...).Handle
+	return must(NewBrotliClient(level, opts...))
+}
+
+func NewBrotliClient(level int, opts ...ClientOption) (client.Middleware, error) {
+	bc, err := newBrotliCliMiddleware(level, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return bc.Handle, nil
+}
+
+func must[T any](v T, err error) T {
+	if err != nil {
+		panic(err)
+	}
+	return v
+}
+
+// ValidateLevel reports an error if level is outside [BestSpeed, BestCompression].
+func ValidateLevel(level int) error {
+	if level < BestSpeed || level > BestCompression {
+		return fmt.Errorf("brotli_hz: invalid compression level %d, must be between %d and %d", level, BestSpeed, BestCompression)
+	}
+	return nil
+}
+
+func validateMinSavingsRatio(ratio float64) error {
+	if ratio < 0 || ratio >= 1 {
+		return fmt.Errorf("brotli_hz: invalid min savings ratio %v, must be in [0, 1)", ratio)
+	}
+	return nil
+}
+
+// saves reports whether compressing n bytes to compressed bytes saves at least
+// minRatio of n, and at least one byte.
+func saves(n, compressed int, minRatio float64) bool {
+	return compressed < n && float64(n-compressed) >= minRatio*float64(n)
+}
+
+func validateWriterOptions(wo brotli.WriterOptions) error {
+	if err := ValidateLevel(wo.Quality); err != nil {
+		return err
+	}
+	if wo.LGWin != 0 && (wo.LGWin < 10 || wo.LGWin > 24) {
+		return fmt.Errorf("brotli_hz: invalid window size %d, must be 0 or between 10 and 24", wo.LGWin)
+	}
+	return nil
+}
+
+var errLargeWindow = errors.New("brotli_hz: large window brotli streams are not supported")
+
+// windowBits reads the WBITS field from the stream header (RFC 7932 section 9.1).
+func windowBits(data []byte) (int, error) {
+	if len(data) == 0 {
+		return 0, errors.New("brotli_hz: empty brotli stream")
+	}
+	b := data[0]
+	if b&1 == 0 {
+		return 16, nil
+	}
+	if n := (b >> 1) & 7; n != 0 {
+		return 17 + int(n), nil
+	}
+	switch m := (b >> 4) & 7; m {
+	case 0:
+		return 17, nil
+	case 1:
+		return 0, errLargeWindow
+	default:
+		return 8 + int(m), nil
+	}
+}
+
+// checkWindow reports an error if the brotli stream in data uses a window
+// larger than maxLGWin, maxLGWin <= 0 disables the check.
+func checkWindow(data []byte, maxLGWin int) error {
+	if maxLGWin <= 0 || len(data) == 0 {
+		return nil
+	}
+	lgwin, err := windowBits(data)
+	if err != nil {
+		return err
+	}
+	if lgwin > maxLGWin {
+		return fmt.Errorf("brotli_hz: window size 2^%d exceeds limit 2^%d", lgwin, maxLGWin)
+	}
+	return nil
 }
@@ -0,0 +1,122 @@
+package brotli_hz
+
+import (
+	"bytes"
+	"errors"
+	"sync"
+)
+
+type asyncOp struct {
+	data  []byte
+	flush bool
+}
+
+// errFinalized is returned by writes and flushes after Finalize.
+var errFinalized = errors.New("brotli_hz: write after finalize")
+
+// asyncWriter moves compression off the handler goroutine: writes and flushes
+// are queued in order and applied to the stream writer by a single goroutine.
+// The queue holds a number of operations, not bytes: every queued write keeps
+// a copy of its data, and a slow encoder blocks the handler once it is full.
+// The goroutine starts with the first write or flush, so a writer which is
+// never used, e.g. replaced for a pre-encoded body, doesn't leave one behind.
+type asyncWriter struct {
+	sync.Once
+	w    *brotliStreamWriter
+	ops  chan asyncOp
+	done chan struct{}
+
+	mu  sync.Mutex
+	err error
+
+	// sendMu orders sends on ops with closing it, the worker never takes it
+	sendMu  sync.Mutex
+	started bool
+	closed  bool
+}
+
+func newAsyncWriter(w *brotliStreamWriter, size int) *asyncWriter {
+	aw := &asyncWriter{
+		w:    w,
+		ops:  make(chan asyncOp, size),
+		done: make(chan struct{}),
+	}
+	return aw
+}
+
+func (aw *asyncWriter) run() {
+	defer close(aw.done)
+	for op := range aw.ops {
+		// drain the queue after a failure so the handler never blocks
+		if aw.loadErr() != nil {
+			continue
+		}
+		var err error
+		if op.flush {
+			err = aw.w.Flush()
+		} else {
+			_, err = aw.w.Write(op.data)
+		}
+		if err != nil {
+			aw.mu.Lock()
+			aw.err = err
+			aw.mu.Unlock()
+		}
+	}
+}
+
+func (aw *asyncWriter) loadErr() error {
+	aw.mu.Lock()
+	defer aw.mu.Unlock()
+	return aw.err
+}
+
+// Write returns the error of a previous write or flush, if any.
+func (aw *asyncWriter) Write(p []byte) (n int, err error) {
+	if err = aw.send(asyncOp{data: bytes.Clone(p)}); err != nil {
+		return
+	}
+	return len(p), nil
+}
+
+func (aw *asyncWriter) Flush() error {
+	return aw.send(asyncOp{flush: true})
+}
+
+func (aw *asyncWriter) send(op asyncOp) error {
+	aw.sendMu.Lock()
+	defer aw.sendMu.Unlock()
+	if aw.closed {
+		return errFinalized
+	}
+	if err := aw.loadErr(); err != nil {
+		return err
+	}
+	// choose the encoding from the headers as set by the handler right now,
+	// the encoder then exists before the worker sees any operation
+	aw.w.writeHeader()
+	if !aw.started {
+		aw.started = true
+		go aw.run()
+	}
+	aw.ops <- op
+	return nil
+}
+
+// Finalize waits for the queued writes before finalizing the stream writer.
+func (aw *asyncWriter) Finalize() error {
+	aw.Do(func() {
+		aw.sendMu.Lock()
+		aw.closed = true
+		close(aw.ops)
+		if !aw.started {
+			close(aw.done)
+		}
+		aw.sendMu.Unlock()
+	})
+	<-aw.done
+	if err := aw.loadErr(); err != nil {
+		return err
+	}
+	return aw.w.Finalize()
+}
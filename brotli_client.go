@@ -6,40 +6,56 @@ import (
 	"github.com/andybalholm/brotli"
 	"github.com/cloudwego/hertz/pkg/app/client"
 	"github.com/cloudwego/hertz/pkg/protocol"
+	"github.com/cloudwego/hertz/pkg/protocol/consts"
 	"path/filepath"
 	"strings"
 )
 
 type brotliCliMiddleware struct {
-	options *ClientOptions
-	level   int
+	options       *ClientOptions
+	writerOptions brotli.WriterOptions
 }
 
-func newBrotliCliMiddleware(level int, opts ...ClientOption) *brotliCliMiddleware {
-	return &brotliCliMiddleware{
-		options: newClientOptions(opts...),
-		level:   level,
+func newBrotliCliMiddleware(level int, opts ...ClientOption) (*brotliCliMiddleware, error) {
+	options := newClientOptions(opts...)
+	if options.err != nil {
+		return nil, options.err
+	}
+	writerOptions := brotli.WriterOptions{Quality: level}
+	if options.WriterOptions != nil {
+		writerOptions = *options.WriterOptions
+	}
+	if err := validateWriterOptions(writerOptions); err != nil {
+		return nil, err
+	}
+	if err := validateMinSavingsRatio(options.MinSavingsRatio); err != nil {
+		return nil, err
 	}
+	return &brotliCliMiddleware{
+		options:       options,
+		writerOptions: writerOptions,
+	}, nil
 }
 
 func (bc *brotliCliMiddleware) Handle(next client.Endpoint) client.Endpoint {
 	return func(ctx context.Context, req *protocol.Request, resp *protocol.Response) (err error) {
 		if !bc.shouldCompress(req) {
-			return
+			return next(ctx, req, resp)
 		}
 
-		req.SetHeader("Content-Encoding", "br")
-		req.SetHeader("Vary", "Accept-Encoding")
-
-		if len(req.Body()) > 0 {
-			var buf bytes.Buffer
-			w := brotli.NewWriterLevel(&buf, bc.level)
-			_, err = w.Write(req.Body())
-			if err != nil {
+		if body := req.Body(); len(body) > 0 {
+			var data []byte
+			if data, err = compress(ctx, body, bc.writerOptions); err != nil {
 				return
 			}
-			w.Close() // nolint:errcheck
-			req.SetBodyStream(&buf, buf.Len())
+			if !bc.options.IdentityFallback || saves(len(body), len(data), bc.options.MinSavingsRatio) {
+				req.SetHeader("Content-Encoding", "br")
+				req.SetHeader("Vary", "Accept-Encoding")
+				req.SetBodyStream(bytes.NewReader(data), len(data))
+			}
+		} else if !bodylessMethod(req) {
+			req.SetHeader("Content-Encoding", "br")
+			req.SetHeader("Vary", "Accept-Encoding")
 		}
 
 		if err = next(ctx, req, resp); err != nil {
@@ -47,6 +63,9 @@ func (bc *brotliCliMiddleware) Handle(next client.Endpoint) client.Endpoint {
 		}
 
 		if fn := bc.options.DecompressFn; fn != nil && strings.EqualFold(resp.Header.Get("Content-Encoding"), "br") {
+			if err = checkWindow(resp.Body(), bc.options.MaxDecompressWindow); err != nil {
+				return
+			}
 			f := fn(next)
 			if err = f(ctx, req, resp); err != nil {
 				return
@@ -63,18 +82,48 @@ func (bc *brotliCliMiddleware) shouldCompress(req *protocol.Request) bool {
 		return false
 	}
 
-	path := string(req.URI().RequestURI())
+	if len(bc.options.Methods) > 0 && !bc.options.Methods.Contains(string(req.Header.Method())) {
+		return false
+	}
+
+	if len(req.Body()) < bc.options.MinLength {
+		return false
+	}
+
+	contentType := string(req.Header.ContentType())
+	if bc.options.ExcludedContentTypes.Contains(contentType) {
+		return false
+	}
+	if len(bc.options.IncludedContentTypes) > 0 && !bc.options.IncludedContentTypes.Contains(contentType) {
+		return false
+	}
+
+	// the normalized path, without the query string
+	path := string(req.URI().Path())
 	ext := filepath.Ext(path)
 
 	if bc.options.ExcludedExtensions.Contains(ext) {
 		return false
 	}
-	if bc.options.ExcludedPaths.Contains(path) {
+	if bc.options.excludedPaths.Contains(path) {
+		return false
+	}
+	if bc.options.excludedRegexes.Contains(path) {
 		return false
 	}
-	if bc.options.ExcludedPathRegexes.Contains(path) {
+	if bc.options.ExcludedPathPatterns.Contains(path) {
 		return false
 	}
 
-	return true
+	return included(path, ext, bc.options.includedPaths, bc.options.includedRegexes, bc.options.IncludedExtensions)
+}
+
+// bodylessMethod reports whether req uses a method which defines no request
+// body, an empty request of such a method gets no encoding headers.
+func bodylessMethod(req *protocol.Request) bool {
+	switch string(req.Header.Method()) {
+	case consts.MethodGet, consts.MethodHead, consts.MethodDelete, consts.MethodOptions, consts.MethodTrace:
+		return true
+	}
+	return false
 }
@@ -0,0 +1,70 @@
+package brotli_hz
+
+import (
+	"bytes"
+	"context"
+	"github.com/andybalholm/brotli"
+	"io"
+)
+
+// brotliCompressReader compresses src lazily as it is read, so only the
+// encoder window and the pending output are held in memory.
+type brotliCompressReader struct {
+	src   io.Reader
+	buf   bytes.Buffer
+	w     *brotli.Writer
+	chunk []byte
+	err   error
+	// ctx stops the encoder once the request is canceled
+	ctx context.Context
+	// release returns the encoder budget, see Limiter
+	release func()
+}
+
+func newBrotliCompressReader(src io.Reader, options brotli.WriterOptions) *brotliCompressReader {
+	r := &brotliCompressReader{
+		src:   src,
+		chunk: make([]byte, 32*1024),
+	}
+	r.w = brotli.NewWriterOptions(&r.buf, options)
+	return r
+}
+
+func (r *brotliCompressReader) Read(p []byte) (int, error) {
+	for r.buf.Len() == 0 {
+		if r.err != nil {
+			return 0, r.err
+		}
+		if r.ctx != nil {
+			if r.err = r.ctx.Err(); r.err != nil {
+				continue
+			}
+		}
+		n, err := r.src.Read(r.chunk)
+		if n > 0 {
+			if _, werr := r.w.Write(r.chunk[:n]); werr != nil {
+				r.err = werr
+				continue
+			}
+		}
+		if err == io.EOF {
+			if r.err = r.w.Close(); r.err == nil {
+				r.err = io.EOF
+			}
+		} else if err != nil {
+			r.err = err
+		}
+	}
+	return r.buf.Read(p)
+}
+
+// Close closes the source stream, hertz calls it once the body is written.
+func (r *brotliCompressReader) Close() error {
+	if r.release != nil {
+		r.release()
+	}
+	if c, ok := r.src.(io.Closer); ok {
+		return c.Close()
+	}
+	return nil
+}
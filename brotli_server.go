@@ -3,77 +3,329 @@ package brotli_hz
 import (
 	"bytes"
 	"context"
+	"crypto/sha256"
+	"fmt"
 	"github.com/andybalholm/brotli"
 	"github.com/cloudwego/hertz/pkg/app"
 	"github.com/cloudwego/hertz/pkg/protocol"
 	"github.com/cloudwego/hertz/pkg/protocol/consts"
+	"net/http"
 	"path/filepath"
 	"strings"
 )
 
 type brotliSrvMiddleware struct {
-	options *Options
-	level   int
+	options       *Options
+	writerOptions brotli.WriterOptions
+	// routes holds the middleware of routes with their own options
+	routes map[string]*brotliSrvMiddleware
 }
 
-func newBrotliSrvMiddleware(level int, opts ...Option) *brotliSrvMiddleware {
-	return &brotliSrvMiddleware{
-		options: newOptions(opts...),
-		level:   level,
+func newBrotliSrvMiddleware(level int, opts ...Option) (*brotliSrvMiddleware, error) {
+	options := newOptions(opts...)
+	if options.err != nil {
+		return nil, options.err
 	}
+	writerOptions := brotli.WriterOptions{Quality: level}
+	if options.WriterOptions != nil {
+		writerOptions = *options.WriterOptions
+	}
+	if err := validateWriterOptions(writerOptions); err != nil {
+		return nil, err
+	}
+	if err := validateMinSavingsRatio(options.MinSavingsRatio); err != nil {
+		return nil, err
+	}
+	if degrade := options.LimitPolicy.Degrade; degrade != nil {
+		if err := validateWriterOptions(*degrade); err != nil {
+			return nil, err
+		}
+	}
+	bs := &brotliSrvMiddleware{
+		options:       options,
+		writerOptions: writerOptions,
+	}
+	for route, routeOpts := range options.RouteOptions {
+		// the route options apply on top of the others, without recursing
+		ropts := append(append([]Option{}, opts...), routeOpts...)
+		ropts = append(ropts, func(o *Options) { o.RouteOptions = nil })
+		rs, err := newBrotliSrvMiddleware(level, ropts...)
+		if err != nil {
+			return nil, fmt.Errorf("brotli_hz: route %s: %w", route, err)
+		}
+		if bs.routes == nil {
+			bs.routes = make(map[string]*brotliSrvMiddleware)
+		}
+		bs.routes[route] = rs
+	}
+	return bs, nil
 }
 
-func (bs *brotliSrvMiddleware) Handle(ctx context.Context, c *app.RequestContext) {
-	if fn := bs.options.DecompressFn; fn != nil && strings.EqualFold(c.Request.Header.Get("Content-Encoding"), "br") {
-		fn(ctx, c)
+// route returns the middleware configured for the matched route, or bs.
+func (bs *brotliSrvMiddleware) route(c *app.RequestContext) *brotliSrvMiddleware {
+	if rs, ok := bs.routes[c.FullPath()]; ok {
+		return rs
 	}
+	return bs
+}
 
-	if !bs.shouldCompress(&c.Request) {
+func (bs *brotliSrvMiddleware) Handle(ctx context.Context, c *app.RequestContext) {
+	bs = bs.route(c)
+	bs.decompress(ctx, c)
+	// an error response is sent as is
+	if c.IsAborted() {
 		return
 	}
 
+	compress := bs.shouldCompress(c)
+
 	c.Next(ctx)
 
-	c.Header("Content-Encoding", "br")
-	c.Header("Vary", "Accept-Encoding")
+	if servePreEncoded(c) || !compress {
+		return
+	}
+	bs.compressResponse(ctx, c)
+}
+
+func (bs *brotliSrvMiddleware) compressResponse(ctx context.Context, c *app.RequestContext) {
+	ctl := getControl(c)
+	if ctl.disable || (!ctl.force && !bs.shouldCompressResponse(&c.Response)) {
+		return
+	}
+
+	// compress body streams as they are written instead of reading them into memory
+	if c.Response.IsBodyStream() {
+		wo, release, ok := bs.acquireEncoder(ctx, c, ctl.writerOptions(bs.writerOptions))
+		if !ok {
+			return
+		}
+		setEncodingHeaders(c)
+		r := newBrotliCompressReader(c.Response.BodyStream(), wo)
+		r.ctx = ctx
+		r.release = release
+		c.Response.SetBodyStreamNoReset(r, -1)
+		return
+	}
+
+	body := c.Response.Body()
 
 	// use brotli in empty body
-	if len(c.Response.Body()) <= 0 {
+	if len(body) <= 0 {
+		setEncodingHeaders(c)
 		return
 	}
 
-	var buf bytes.Buffer
-	w := brotli.NewWriterLevel(&buf, bs.level)
-	defer func() {
-		w.Close() // nolint:errcheck
-		c.Response.SetBodyStream(&buf, buf.Len())
-	}()
-	_, err := w.Write(c.Response.Body())
+	var key string
+	if cache := bs.options.Cache; cache != nil && ctl.level == nil {
+		key = bs.cacheKey(c, body)
+		if data, ok := cache.Get(key); ok {
+			setEncodingHeaders(c)
+			c.Response.SetBodyStream(bytes.NewReader(data), len(data))
+			return
+		}
+	}
+
+	wo, release, ok := bs.acquireEncoder(ctx, c, ctl.writerOptions(bs.writerOptions))
+	if !ok {
+		return
+	}
+	cctx := ctx
+	if timeout := bs.options.CompressionTimeout; timeout > 0 {
+		var cancel context.CancelFunc
+		cctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+	data, err := compress(cctx, body, wo)
+	release()
 	if err != nil {
+		// out of time or the client is gone, send the body as is
+		if cctx.Err() != nil {
+			return
+		}
 		_ = c.AbortWithError(consts.StatusBadRequest, err)
+		return
+	}
+	if bs.options.IdentityFallback && !ctl.force && !saves(len(body), len(data), bs.options.MinSavingsRatio) {
+		return
+	}
+	// degraded output is not worth caching
+	if key != "" && wo == bs.writerOptions {
+		bs.options.Cache.Set(key, data)
 	}
+	setEncodingHeaders(c)
+	c.Response.SetBodyStream(bytes.NewReader(data), len(data))
+}
+
+func setEncodingHeaders(c *app.RequestContext) {
+	c.Header("Content-Encoding", "br")
+	c.Header("Vary", "Accept-Encoding")
 }
 
-func (bs *brotliSrvMiddleware) shouldCompress(req *protocol.Request) bool {
-	if !(strings.Contains(req.Header.Get("Accept-Encoding"), "br") ||
-		strings.TrimSpace(req.Header.Get("Accept-Encoding")) == "*") ||
+// compressSliceSize is how much input compress encodes between checks of ctx.
+const compressSliceSize = 4 * 1024
+
+// compress checks ctx between slices of the body. The encoder buffers input
+// and does most of its work when it flushes, so if ctx can be canceled every
+// slice is flushed. That bounds the work past a deadline to one slice, which
+// at level 11 still takes milliseconds, and costs about 1% of output size.
+func compress(ctx context.Context, body []byte, wo brotli.WriterOptions) ([]byte, error) {
+	var buf bytes.Buffer
+	w := brotli.NewWriterOptions(&buf, wo)
+	cancelable := ctx.Done() != nil
+	for len(body) > 0 {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		n := min(len(body), compressSliceSize)
+		if _, err := w.Write(body[:n]); err != nil {
+			w.Close() // nolint:errcheck
+			return nil, err
+		}
+		if cancelable {
+			if err := w.Flush(); err != nil {
+				w.Close() // nolint:errcheck
+				return nil, err
+			}
+		}
+		body = body[n:]
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// cacheKey prefers a strong ETag set by the handler, which saves hashing the
+// body. An ETag only identifies a representation of one resource, so the key
+// includes the host and the full request URI. Weak ETags don't promise
+// identical bytes and fall back to the hash.
+func (bs *brotliSrvMiddleware) cacheKey(c *app.RequestContext, body []byte) string {
+	if etag := c.Response.Header.Get("ETag"); etag != "" && !strings.HasPrefix(etag, "W/") {
+		return fmt.Sprintf("%d:%d:etag:%s:%s:%s", bs.writerOptions.Quality, bs.writerOptions.LGWin, c.Request.Host(), c.Request.URI().RequestURI(), etag)
+	}
+	return fmt.Sprintf("%d:%d:sha256:%x", bs.writerOptions.Quality, bs.writerOptions.LGWin, sha256.Sum256(body))
+}
+
+func (bs *brotliSrvMiddleware) decompress(ctx context.Context, c *app.RequestContext) {
+	fn := bs.options.DecompressFn
+	codings := contentCodings(c.Request.Header.Get("Content-Encoding"))
+	if fn == nil || len(codings) == 0 {
+		return
+	}
+	// a custom fn may only know br
+	if !bs.options.decompressAll && (len(codings) > 1 || codings[0] != "br") {
+		return
+	}
+	if codings[len(codings)-1] == "br" {
+		if err := checkWindow(c.Request.Body(), bs.options.MaxDecompressWindow); err != nil {
+			_ = c.AbortWithError(consts.StatusBadRequest, err)
+			return
+		}
+	}
+	fn(ctx, c)
+}
+
+func (bs *brotliSrvMiddleware) shouldCompressResponse(resp *protocol.Response) bool {
+	if !bs.compressibleStatus(resp) {
+		return false
+	}
+	if n := bodyLength(resp); n >= 0 && n < bs.options.MinLength {
+		return false
+	}
+	body := resp.Body()
+	if resp.IsBodyStream() {
+		body = nil
+	}
+	if !bs.compressibleContentType(bs.contentType(resp, body)) {
+		return false
+	}
+	// body streams are not sampled, reading them would defeat streaming
+	if p := bs.options.Probe; p != nil && !resp.IsBodyStream() && unknownContentType(resp) {
+		return p.compressible(resp.Body())
+	}
+	return true
+}
+
+func (bs *brotliSrvMiddleware) compressibleStatus(resp *protocol.Response) bool {
+	return len(bs.options.StatusCodes) == 0 || bs.options.StatusCodes.Contains(resp.StatusCode())
+}
+
+// contentType sniffs the Content-Type from the body prefix if the handler set
+// none and sniffing is enabled, hertz would report text/plain otherwise.
+func (bs *brotliSrvMiddleware) contentType(resp *protocol.Response, prefix []byte) string {
+	if !bs.options.SniffContentType || len(prefix) == 0 || len(responseContentType(resp)) > 0 {
+		return string(resp.Header.ContentType())
+	}
+	contentType := http.DetectContentType(prefix)
+	if bs.options.SetSniffedContentType {
+		resp.Header.SetContentType(contentType)
+	}
+	return contentType
+}
+
+func (bs *brotliSrvMiddleware) compressibleContentType(contentType string) bool {
+	if bs.options.ExcludedContentTypes.Contains(contentType) {
+		return false
+	}
+	if len(bs.options.IncludedContentTypes) > 0 && !bs.options.IncludedContentTypes.Contains(contentType) {
+		return false
+	}
+	return true
+}
+
+func acceptsBrotli(req *protocol.Request) bool {
+	return strings.Contains(req.Header.Get("Accept-Encoding"), "br") ||
+		strings.TrimSpace(req.Header.Get("Accept-Encoding")) == "*"
+}
+
+func (bs *brotliSrvMiddleware) shouldCompress(c *app.RequestContext) bool {
+	req := &c.Request
+	if !acceptsBrotli(req) ||
 		strings.Contains(req.Header.Get("Connection"), "Upgrade") ||
-		strings.Contains(req.Header.Get("Content-Type"), "text/event-stream") {
+		(!bs.options.EventStream && strings.Contains(req.Header.Get("Content-Type"), "text/event-stream")) {
+		return false
+	}
+
+	if len(bs.options.Methods) > 0 && !bs.options.Methods.Contains(string(req.Header.Method())) {
 		return false
 	}
 
-	path := string(req.URI().RequestURI())
+	// the route as registered, e.g. /users/:id, empty if no route matched
+	route := c.FullPath()
+	if bs.options.ExcludedRoutes.Contains(route) {
+		return false
+	}
+	if len(bs.options.IncludedRoutes) > 0 && !bs.options.IncludedRoutes.Contains(route) {
+		return false
+	}
+
+	// the normalized path, without the query string
+	path := string(req.URI().Path())
 	ext := filepath.Ext(path)
 
 	if bs.options.ExcludedExtensions.Contains(ext) {
 		return false
 	}
-	if bs.options.ExcludedPaths.Contains(path) {
+	if bs.options.excludedPaths.Contains(path) {
 		return false
 	}
-	if bs.options.ExcludedPathRegexes.Contains(path) {
+	if bs.options.excludedRegexes.Contains(path) {
+		return false
+	}
+	if bs.options.ExcludedPathPatterns.Contains(path) {
 		return false
 	}
 
-	return true
+	return included(path, ext, bs.options.includedPaths, bs.options.includedRegexes, bs.options.IncludedExtensions)
+}
+
+// bodyLength returns -1 for body streams of unknown size, without reading them.
+func bodyLength(resp *protocol.Response) int {
+	if resp.IsBodyStream() {
+		return resp.Header.ContentLength()
+	}
+	return len(resp.Body())
 }
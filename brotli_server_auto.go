@@ -0,0 +1,114 @@
+package brotli_hz
+
+import (
+	"bytes"
+	"context"
+	"github.com/cloudwego/hertz/pkg/app"
+	"github.com/cloudwego/hertz/pkg/network"
+)
+
+// brotliAutoWriter buffers the handler output until the handler flushes or
+// the buffer exceeds limit, then hands over to a streaming writer.
+type brotliAutoWriter struct {
+	buf    bytes.Buffer
+	limit  int
+	stream network.ExtWriter
+	// newStream receives the buffered prefix of the body
+	newStream func(prefix []byte) network.ExtWriter
+}
+
+func (aw *brotliAutoWriter) Write(p []byte) (n int, err error) {
+	if aw.stream != nil {
+		return aw.stream.Write(p)
+	}
+	aw.buf.Write(p)
+	if aw.buf.Len() > aw.limit {
+		if err = aw.switchToStream(); err != nil {
+			return
+		}
+	}
+	return len(p), nil
+}
+
+// SetBody keeps the semantics of Response.SetBody while buffering.
+func (aw *brotliAutoWriter) SetBody(b []byte) {
+	if aw.stream == nil {
+		aw.buf.Reset()
+	}
+	aw.Write(b) //nolint:errcheck
+}
+
+func (aw *brotliAutoWriter) Flush() error {
+	if aw.stream == nil {
+		if err := aw.switchToStream(); err != nil {
+			return err
+		}
+	}
+	return aw.stream.Flush()
+}
+
+func (aw *brotliAutoWriter) Finalize() error {
+	if aw.stream == nil {
+		return nil
+	}
+	return aw.stream.Finalize()
+}
+
+func (aw *brotliAutoWriter) switchToStream() error {
+	aw.stream = aw.newStream(aw.buf.Bytes())
+	if aw.buf.Len() == 0 {
+		return nil
+	}
+	_, err := aw.stream.Write(aw.buf.Bytes())
+	aw.buf.Reset()
+	return err
+}
+
+func (bs *brotliSrvMiddleware) AutoHandle(ctx context.Context, c *app.RequestContext) {
+	bs = bs.route(c)
+	bs.decompress(ctx, c)
+	// an error response is sent as is
+	if c.IsAborted() {
+		return
+	}
+
+	if !bs.shouldCompress(c) {
+		c.Next(ctx)
+		servePreEncoded(c)
+		return
+	}
+
+	pw := protocolWriter(c)
+	if pw == nil {
+		c.Next(ctx)
+		if !servePreEncoded(c) {
+			bs.compressResponse(ctx, c)
+		}
+		return
+	}
+
+	prev := c.Response.GetHijackWriter()
+	w := &brotliAutoWriter{
+		limit: bs.options.BufferSize,
+		newStream: func(prefix []byte) network.ExtWriter {
+			return bs.newStreamWriter(ctx, c, pw, prefix)
+		},
+	}
+	c.Response.HijackWriter(w)
+
+	c.Next(ctx)
+
+	if w.stream != nil {
+		return
+	}
+
+	// the handler completed within the buffer, respond with Content-Length
+	c.Response.HijackWriter(prev)
+	if servePreEncoded(c) {
+		return
+	}
+	if w.buf.Len() > 0 && !c.Response.IsBodyStream() {
+		c.Response.SetBody(w.buf.Bytes())
+	}
+	bs.compressResponse(ctx, c)
+}
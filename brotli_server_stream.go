@@ -7,96 +7,308 @@ import (
 	"github.com/cloudwego/hertz/pkg/app"
 	"github.com/cloudwego/hertz/pkg/network"
 	"github.com/cloudwego/hertz/pkg/protocol"
-	"github.com/cloudwego/hertz/pkg/protocol/http1/ext"
+	"github.com/cloudwego/hertz/pkg/protocol/consts"
 	"github.com/cloudwego/hertz/pkg/protocol/http1/resp"
-	"strings"
 	"sync"
 )
 
-type brotliChunkedWriter struct {
+// brotliStreamWriter compresses every write and hands it to the protocol
+// writer, which owns the framing of the response (chunked encoding, ...).
+type brotliStreamWriter struct {
 	sync.Once
 	finalizeErr error
 	wroteHeader bool
 	r           *protocol.Response
-	w           network.Writer
-	level       int
+	w           network.ExtWriter
+	options     brotli.WriterOptions
+
+	// continuous enables a single brotli stream for the whole response,
+	// eventStream only for text/event-stream responses, which are then flushed
+	// per event. encoder and buf are set once such a response starts.
+	continuous  bool
+	eventStream bool
+	events      bool
+	encoder     *brotli.Writer
+	buf         bytes.Buffer
+	tail        []byte
+
+	// shouldCompress decides once the handler starts writing, e.g. on the
+	// status code. identity passes the response through if it declined.
+	shouldCompress func(r *protocol.Response) bool
+	identity       bool
+	// release returns the encoder budget once the response is finalized
+	release func()
 }
 
+// NewBrotliChunkedWriter compresses the response with HTTP/1.1 chunked encoding.
 func NewBrotliChunkedWriter(r *protocol.Response, w network.Writer, level int) network.ExtWriter {
-	return &brotliChunkedWriter{
-		r:     r,
-		w:     w,
-		level: level,
+	return NewBrotliStreamWriter(r, resp.NewChunkedBodyWriter(r, w), level)
+}
+
+// NewBrotliStreamWriter compresses the response on top of any protocol writer,
+// such as one installed earlier with Response.HijackWriter.
+func NewBrotliStreamWriter(r *protocol.Response, w network.ExtWriter, level int) network.ExtWriter {
+	return newBrotliStreamWriter(r, w, brotli.WriterOptions{Quality: level})
+}
+
+func newBrotliStreamWriter(r *protocol.Response, w network.ExtWriter, options brotli.WriterOptions) *brotliStreamWriter {
+	return &brotliStreamWriter{
+		r:       r,
+		w:       w,
+		options: options,
 	}
 }
 
-func (bc *brotliChunkedWriter) Write(p []byte) (n int, err error) {
+func (bw *brotliStreamWriter) Write(p []byte) (n int, err error) {
+	bw.writeHeader()
+	if bw.identity {
+		return bw.w.Write(p)
+	}
+	if bw.events {
+		return bw.writeEvents(p)
+	}
+	if bw.encoder != nil {
+		if _, err = bw.encoder.Write(p); err != nil {
+			return
+		}
+		return len(p), bw.writeEncoded()
+	}
+
 	var buf bytes.Buffer
-	w := brotli.NewWriterLevel(&buf, bc.level)
+	w := brotli.NewWriterOptions(&buf, bw.options)
 	if _, err = w.Write(p); err != nil {
 		return
 	}
 	w.Close() // nolint:errcheck
 
-	if !bc.wroteHeader {
-		bc.r.Header.SetContentLength(-1)
-		bc.r.Header.Set("Content-Encoding", "br")
-		bc.r.Header.Set("Vary", "Accept-Encoding")
-		if err = resp.WriteHeader(&bc.r.Header, bc.w); err != nil {
+	if _, err = bw.w.Write(buf.Bytes()); err != nil {
+		return
+	}
+
+	n = buf.Len()
+	return
+}
+
+// writeEvents feeds the event stream encoder and flushes it once p completes
+// an event, i.e. the data written so far ends with a blank line.
+func (bw *brotliStreamWriter) writeEvents(p []byte) (n int, err error) {
+	if _, err = bw.encoder.Write(p); err != nil {
+		return
+	}
+
+	// keep the end of the previous writes, a blank line may span two writes
+	data := append(bw.tail, p...)
+	end := lastEventEnd(data)
+	rest := data[max(0, end):]
+	bw.tail = append([]byte(nil), rest[max(0, len(rest)-3):]...)
+	if end >= 0 {
+		if err = bw.Flush(); err != nil {
 			return
 		}
-		bc.wroteHeader = true
 	}
+	return len(p), nil
+}
 
-	if err = ext.WriteChunk(bc.w, buf.Bytes(), false); err != nil {
-		return
+// lastEventEnd returns the index after the last blank line in data, or -1.
+func lastEventEnd(data []byte) int {
+	end := -1
+	for _, sep := range []string{"\n\n", "\r\r", "\r\n\r\n"} {
+		if i := bytes.LastIndex(data, []byte(sep)); i >= 0 {
+			end = max(end, i+len(sep))
+		}
 	}
+	return end
+}
 
-	n = buf.Len()
-	return
+// writeEncoded hands the pending encoder output to the protocol writer.
+func (bw *brotliStreamWriter) writeEncoded() error {
+	if bw.buf.Len() == 0 {
+		return nil
+	}
+	// the protocol writer may keep p until it is flushed
+	p := append([]byte(nil), bw.buf.Bytes()...)
+	bw.buf.Reset()
+	_, err := bw.w.Write(p)
+	return err
 }
 
-func (bc *brotliChunkedWriter) Flush() error {
-	return bc.w.Flush()
+func (bw *brotliStreamWriter) Flush() error {
+	if bw.encoder != nil {
+		if err := bw.encoder.Flush(); err != nil {
+			return err
+		}
+		if err := bw.writeEncoded(); err != nil {
+			return err
+		}
+	}
+	return bw.w.Flush()
 }
 
-func (bc *brotliChunkedWriter) Finalize() error {
-	bc.Do(func() {
+func (bw *brotliStreamWriter) Finalize() error {
+	bw.Do(func() {
+		if bw.release != nil {
+			defer bw.release()
+		}
 		// in case no actual data from user
-		if !bc.wroteHeader {
-			// use Transfer-Encoding: chunked.
-			bc.r.Header.SetContentLength(-1)
-			bc.r.Header.Set("Content-Encoding", "br")
-			bc.r.Header.Set("Vary", "Accept-Encoding")
-			if bc.finalizeErr = resp.WriteHeader(&bc.r.Header, bc.w); bc.finalizeErr != nil {
+		bw.writeHeader()
+		if bw.encoder != nil {
+			if bw.finalizeErr = bw.encoder.Close(); bw.finalizeErr != nil {
+				return
+			}
+			if bw.finalizeErr = bw.writeEncoded(); bw.finalizeErr != nil {
 				return
 			}
-			bc.wroteHeader = true
 		}
+		bw.finalizeErr = bw.w.Finalize()
+	})
+	return bw.finalizeErr
+}
 
-		// write the ending chunk
-		bc.finalizeErr = ext.WriteChunk(bc.w, nil, true)
-		if bc.finalizeErr != nil {
-			return
-		}
+// writeHeader sets the encoding headers before the protocol writer sends them.
+func (bw *brotliStreamWriter) writeHeader() {
+	if bw.wroteHeader {
+		return
+	}
+	bw.wroteHeader = true
+	if bw.shouldCompress != nil && !bw.shouldCompress(bw.r) {
+		bw.identity = true
+		return
+	}
+	bw.r.Header.Set("Content-Encoding", "br")
+	bw.r.Header.Set("Vary", "Accept-Encoding")
+	bw.events = bw.eventStream && bytes.HasPrefix(bw.r.Header.ContentType(), []byte("text/event-stream"))
+	if bw.continuous || bw.events {
+		bw.encoder = brotli.NewWriterOptions(&bw.buf, bw.options)
+	}
+}
+
+// identityBodyWriter delimits the body by closing the connection, for HTTP/1.0
+// clients which don't understand chunked encoding.
+type identityBodyWriter struct {
+	sync.Once
+	finalizeErr error
+	wroteHeader bool
+	r           *protocol.Response
+	w           network.Writer
+}
 
-		// write trailer
-		bc.finalizeErr = ext.WriteTrailer(bc.r.Header.Trailer(), bc.w)
+func (iw *identityBodyWriter) Write(p []byte) (n int, err error) {
+	if err = iw.writeHeader(); err != nil {
+		return
+	}
+	if _, err = iw.w.WriteBinary(p); err != nil {
+		return
+	}
+	return len(p), nil
+}
+
+func (iw *identityBodyWriter) Flush() error {
+	return iw.w.Flush()
+}
+
+func (iw *identityBodyWriter) Finalize() error {
+	iw.Do(func() {
+		iw.finalizeErr = iw.writeHeader()
 	})
-	return bc.finalizeErr
+	return iw.finalizeErr
+}
+
+func (iw *identityBodyWriter) writeHeader() error {
+	if iw.wroteHeader {
+		return nil
+	}
+	// -2 also sets Connection: close, HTTP/1.0 clients don't need the
+	// Transfer-Encoding: identity it adds
+	iw.r.Header.SetContentLength(-2)
+	iw.r.Header.Del("Transfer-Encoding")
+	if err := resp.WriteHeader(&iw.r.Header, iw.w); err != nil {
+		return err
+	}
+	iw.wroteHeader = true
+	return nil
+}
+
+// protocolWriter returns the writer which frames a streamed response: a
+// writer installed earlier with Response.HijackWriter, a connection delimited
+// body for HTTP/1.0 or chunked encoding for HTTP/1.1. It returns nil for other
+// protocols such as HTTP/2, whose server frames the response itself, the
+// response is then compressed once the handler returns.
+func protocolWriter(c *app.RequestContext) network.ExtWriter {
+	if w := c.Response.GetHijackWriter(); w != nil {
+		return w
+	}
+	switch c.Request.Header.GetProtocol() {
+	case consts.HTTP10:
+		return &identityBodyWriter{r: &c.Response, w: c.GetWriter()}
+	case consts.HTTP11, "":
+		return resp.NewChunkedBodyWriter(&c.Response, c.GetWriter())
+	}
+	return nil
+}
+
+// newStreamWriter decides whether to compress at the first write, on the
+// status and the content type, which is sniffed from prefix if enabled.
+func (bs *brotliSrvMiddleware) newStreamWriter(ctx context.Context, c *app.RequestContext, w network.ExtWriter, prefix []byte) network.ExtWriter {
+	sw := newBrotliStreamWriter(&c.Response, w, bs.writerOptions)
+	sw.eventStream = bs.options.EventStream
+	sw.continuous = bs.options.FlushPolicy != nil
+	sw.shouldCompress = func(r *protocol.Response) bool {
+		ctl := getControl(c)
+		if !ctl.decide(bs.compressibleStatus(r) && bs.compressibleContentType(bs.contentType(r, prefix))) {
+			return false
+		}
+		// the encoder is allocated now, it holds the budget until Finalize
+		wo, release, ok := bs.acquireEncoder(ctx, c, ctl.writerOptions(bs.writerOptions))
+		if !ok {
+			return false
+		}
+		sw.options = wo
+		sw.release = release
+		return true
+	}
+
+	var ew network.ExtWriter = sw
+	if size := bs.options.AsyncQueueSize; size > 0 {
+		ew = newAsyncWriter(sw, size)
+	}
+	if policy := bs.options.FlushPolicy; policy != nil {
+		ew = newAutoFlushWriter(ew, *policy)
+	}
+	return ew
 }
 
 func (bs *brotliSrvMiddleware) StreamHandle(ctx context.Context, c *app.RequestContext) {
-	if fn := bs.options.DecompressFn; fn != nil && strings.EqualFold(c.Request.Header.Get("Content-Encoding"), "br") {
-		fn(ctx, c)
+	bs = bs.route(c)
+	bs.decompress(ctx, c)
+	// an error response is sent as is
+	if c.IsAborted() {
+		return
+	}
+
+	if !bs.shouldCompress(c) {
+		c.Next(ctx)
+		servePreEncoded(c)
+		return
 	}
 
-	if !bs.shouldCompress(&c.Request) {
+	pw := protocolWriter(c)
+	if pw == nil {
+		c.Next(ctx)
+		if !servePreEncoded(c) {
+			bs.compressResponse(ctx, c)
+		}
 		return
 	}
 
-	w := NewBrotliChunkedWriter(&c.Response, c.GetWriter(), bs.level)
+	prev := c.Response.GetHijackWriter()
+	w := bs.newStreamWriter(ctx, c, pw, nil)
 	c.Response.HijackWriter(w)
 
 	c.Next(ctx)
+
+	// a pre-encoded body stream bypasses the hijack writer, let hertz send it
+	if preEncoded(c) {
+		c.Response.HijackWriter(prev)
+		servePreEncoded(c)
+	}
 }
@@ -1,8 +1,13 @@
 package brotli_hz
 
 import (
+	"bufio"
 	"bytes"
+	"compress/gzip"
+	"compress/zlib"
 	"context"
+	"crypto/rand"
+	"errors"
 	"fmt"
 	"github.com/andybalholm/brotli"
 	"github.com/cloudwego/hertz/pkg/app"
@@ -13,11 +18,17 @@ import (
 	"github.com/cloudwego/hertz/pkg/protocol"
 	"github.com/cloudwego/hertz/pkg/protocol/consts"
 	"github.com/cloudwego/hertz/pkg/route"
+	"github.com/klauspost/compress/zstd"
 	"github.com/stretchr/testify/assert"
 	"io"
+	mrand "math/rand"
+	"net"
 	"net/http"
+	"regexp"
+	"runtime"
 	"strconv"
 	"strings"
+	"sync"
 	"testing"
 	"time"
 )
@@ -382,6 +393,23 @@ func TestClientNoBrotli(t *testing.T) {
 	assert.Equal(t, req.Header.Get("Content-Length"), "3")
 }
 
+func TestClientSkippedRequestIsSent(t *testing.T) {
+	mw, err := newBrotliCliMiddleware(DefaultCompression, WithClientMinLength(1024))
+	assert.Nil(t, err)
+
+	sent := false
+	next := func(ctx context.Context, req *protocol.Request, resp *protocol.Response) error {
+		sent = true
+		return nil
+	}
+	req := protocol.AcquireRequest()
+	req.SetBodyString("bar")
+	assert.Nil(t, mw.Handle(next)(context.Background(), req, protocol.AcquireResponse()))
+	assert.True(t, sent)
+	assert.Equal(t, "", req.Header.Get("Content-Encoding"))
+	assert.Equal(t, "bar", string(req.Body()))
+}
+
 func TestClientDecompressBrotli(t *testing.T) {
 	h := server.Default(server.WithHostPorts("127.0.0.1:2338"))
 
@@ -497,3 +525,1590 @@ func TestStreamBrotli(t *testing.T) {
 	assert.Equal(t, secondData, string(secondChunk))
 	assert.Equal(t, thirdData, string(thirdChunk))
 }
+
+func TestBrotliCache(t *testing.T) {
+	cache := NewResponseCache(1<<20, time.Minute)
+	router := route.NewEngine(config.NewOptions([]config.Option{}))
+	router.Use(Brotli(DefaultCompression, WithCache(cache)))
+	router.GET("/", func(ctx context.Context, c *app.RequestContext) {
+		c.String(200, testResponse)
+	})
+	router.GET("/etag", func(ctx context.Context, c *app.RequestContext) {
+		c.Header("ETag", `"v1"`)
+		c.String(200, testResponse)
+	})
+
+	var bodies [][]byte
+	for _, path := range []string{"/", "/", "/etag", "/etag"} {
+		w := ut.PerformRequest(router, consts.MethodGet, path, nil, ut.Header{
+			Key: "Accept-Encoding", Value: "br",
+		}).Result()
+		assert.Equal(t, http.StatusOK, w.StatusCode())
+		assert.Equal(t, "br", w.Header.Get("Content-Encoding"))
+		assert.Equal(t, fmt.Sprint(len(w.Body())), w.Header.Get("Content-Length"))
+		bodies = append(bodies, w.Body())
+	}
+	assert.Equal(t, bodies[0], bodies[1])
+	assert.Equal(t, bodies[2], bodies[3])
+
+	data, err := io.ReadAll(brotli.NewReader(bytes.NewReader(bodies[1])))
+	assert.Nil(t, err)
+	assert.Equal(t, testResponse, string(data))
+
+	stats := cache.Stats()
+	assert.Equal(t, uint64(2), stats.Hits)
+	assert.Equal(t, uint64(2), stats.Misses)
+	assert.Equal(t, 2, stats.Entries)
+}
+
+func TestResponseCacheEviction(t *testing.T) {
+	cache := NewResponseCache(8, 0)
+	cache.Set("a", []byte("1234"))
+	cache.Set("b", []byte("1234"))
+	_, _ = cache.Get("a")
+	cache.Set("c", []byte("1234"))
+	cache.Set("d", []byte("123456789"))
+
+	_, ok := cache.Get("b")
+	assert.False(t, ok)
+	_, ok = cache.Get("a")
+	assert.True(t, ok)
+	_, ok = cache.Get("d")
+	assert.False(t, ok)
+	assert.Equal(t, int64(8), cache.Stats().Bytes)
+
+	cache = NewResponseCache(8, time.Millisecond)
+	cache.Set("a", []byte("1234"))
+	time.Sleep(5 * time.Millisecond)
+	_, ok = cache.Get("a")
+	assert.False(t, ok)
+	assert.Equal(t, 0, cache.Stats().Entries)
+}
+
+func TestWindowBits(t *testing.T) {
+	for _, lgwin := range []int{10, 16, 17, 20, 24} {
+		var buf bytes.Buffer
+		bw := brotli.NewWriterOptions(&buf, brotli.WriterOptions{Quality: DefaultCompression, LGWin: lgwin})
+		_, _ = bw.Write([]byte(testResponse))
+		bw.Close() // nolint:errcheck
+
+		bits, err := windowBits(buf.Bytes())
+		assert.Nil(t, err)
+		assert.Equal(t, lgwin, bits)
+		assert.Nil(t, checkWindow(buf.Bytes(), lgwin))
+		assert.NotNil(t, checkWindow(buf.Bytes(), lgwin-1))
+	}
+}
+
+func TestWriterOptions(t *testing.T) {
+	router := route.NewEngine(config.NewOptions([]config.Option{}))
+	router.Use(Brotli(BestCompression, WithWriterOptions(brotli.WriterOptions{Quality: 5, LGWin: 12})))
+	router.GET("/", func(ctx context.Context, c *app.RequestContext) {
+		c.String(200, testResponse)
+	})
+	w := ut.PerformRequest(router, consts.MethodGet, "/", nil, ut.Header{
+		Key: "Accept-Encoding", Value: "br",
+	}).Result()
+	assert.Equal(t, http.StatusOK, w.StatusCode())
+	assert.Equal(t, "br", w.Header.Get("Content-Encoding"))
+	bits, err := windowBits(w.Body())
+	assert.Nil(t, err)
+	assert.Equal(t, 12, bits)
+}
+
+func TestMaxDecompressWindow(t *testing.T) {
+	var buf bytes.Buffer
+	bw := brotli.NewWriterOptions(&buf, brotli.WriterOptions{Quality: DefaultCompression, LGWin: 22})
+	_, _ = bw.Write([]byte(testResponse))
+	bw.Close() // nolint:errcheck
+
+	router := route.NewEngine(config.NewOptions([]config.Option{}))
+	router.Use(Brotli(DefaultCompression, WithDecompressFn(DefaultDecompressHandle), WithMaxDecompressWindow(16)))
+	router.POST("/", func(ctx context.Context, c *app.RequestContext) {
+		c.String(200, "ok")
+	})
+	request := ut.PerformRequest(router, consts.MethodPost, "/", &ut.Body{Body: &buf, Len: buf.Len()},
+		ut.Header{Key: "Content-Encoding", Value: "br"})
+	w := request.Result()
+	assert.Equal(t, http.StatusBadRequest, w.StatusCode())
+}
+
+func TestLevelValidation(t *testing.T) {
+	for _, level := range []int{-5, 12, 42} {
+		_, err := NewBrotli(level)
+		assert.NotNil(t, err)
+		_, err = NewBrotliStream(level)
+		assert.NotNil(t, err)
+		_, err = NewBrotliClient(level)
+		assert.NotNil(t, err)
+		assert.Panics(t, func() { Brotli(level) })
+	}
+	_, err := NewBrotli(DefaultCompression, WithWriterOptions(brotli.WriterOptions{Quality: DefaultCompression, LGWin: 30}))
+	assert.NotNil(t, err)
+	_, err = NewBrotli(42, WithPreset(PresetBalanced))
+	assert.Nil(t, err)
+}
+
+func TestPreset(t *testing.T) {
+	long := strings.Repeat(`{"name":"brotli"}`, 100)
+	router := route.NewEngine(config.NewOptions([]config.Option{}))
+	router.Use(Brotli(DefaultCompression, WithPreset(PresetRealtime)))
+	router.GET("/short", func(ctx context.Context, c *app.RequestContext) {
+		c.Data(200, "application/json", []byte(`{"name":"brotli"}`))
+	})
+	router.GET("/json", func(ctx context.Context, c *app.RequestContext) {
+		c.Data(200, "application/json; charset=utf-8", []byte(long))
+	})
+	router.GET("/binary", func(ctx context.Context, c *app.RequestContext) {
+		c.Data(200, "application/octet-stream", []byte(long))
+	})
+
+	for path, encoding := range map[string]string{"/short": "", "/json": "br", "/binary": ""} {
+		w := ut.PerformRequest(router, consts.MethodGet, path, nil, ut.Header{
+			Key: "Accept-Encoding", Value: "br",
+		}).Result()
+		assert.Equal(t, http.StatusOK, w.StatusCode())
+		assert.Equal(t, encoding, w.Header.Get("Content-Encoding"), path)
+		assert.Equal(t, fmt.Sprint(len(w.Body())), w.Header.Get("Content-Length"))
+	}
+}
+
+func TestContentTypes(t *testing.T) {
+	cts := NewContentTypes([]string{"text/*", "Application/JSON"})
+	assert.True(t, cts.Contains("text/html; charset=utf-8"))
+	assert.True(t, cts.Contains("application/json"))
+	assert.False(t, cts.Contains("application/octet-stream"))
+	assert.False(t, cts.Contains(""))
+}
+
+func TestConfig(t *testing.T) {
+	cfg, err := ParseYAMLConfig([]byte(`
+preset: balanced
+level: 5
+excluded_paths: ["/api/"]
+min_length: 4
+decompress: true
+`))
+	assert.Nil(t, err)
+	opts, err := cfg.Options()
+	assert.Nil(t, err)
+	clientOpts, err := cfg.ClientOptions()
+	assert.Nil(t, err)
+	assert.NotEmpty(t, clientOpts)
+
+	options := newOptions(opts...)
+	assert.Equal(t, brotli.WriterOptions{Quality: 5, LGWin: PresetBalanced.LGWin}, *options.WriterOptions)
+	assert.Equal(t, 4, options.MinLength)
+	assert.True(t, options.ExcludedPaths.Contains("/api/books"))
+	assert.True(t, options.IncludedContentTypes.Contains("application/json"))
+	assert.NotNil(t, options.DecompressFn)
+
+	_, err = ParseJSONConfig([]byte(`{"level": 5, "unknown": true}`))
+	assert.NotNil(t, err)
+
+	_, err = ParseJSONConfig([]byte(`{
+		"preset": "fast",
+		"level": 42,
+		"excluded_extensions": ["png"],
+		"excluded_path_regexes": ["("],
+		"min_length": -1
+	}`))
+	assert.NotNil(t, err)
+	for _, msg := range []string{"preset", "level", "extension", "regex", "min length"} {
+		assert.Contains(t, err.Error(), msg)
+	}
+}
+
+type closeRecorder struct {
+	io.Reader
+	closed bool
+}
+
+func (cr *closeRecorder) Close() error {
+	cr.closed = true
+	return nil
+}
+
+func TestBrotliBodyStream(t *testing.T) {
+	content := strings.Repeat("this is a large file!\n", 100000)
+	stream := &closeRecorder{Reader: strings.NewReader(content)}
+	router := route.NewEngine(config.NewOptions([]config.Option{}))
+	router.Use(Brotli(DefaultCompression))
+	router.GET("/file.txt", func(ctx context.Context, c *app.RequestContext) {
+		c.SetBodyStream(stream, len(content))
+	})
+	w := ut.PerformRequest(router, consts.MethodGet, "/file.txt", nil, ut.Header{
+		Key: "Accept-Encoding", Value: "br",
+	}).Result()
+	assert.Equal(t, http.StatusOK, w.StatusCode())
+	assert.Equal(t, "br", w.Header.Get("Content-Encoding"))
+	assert.Less(t, len(w.Body()), len(content))
+
+	data, err := io.ReadAll(brotli.NewReader(bytes.NewReader(w.Body())))
+	assert.Nil(t, err)
+	assert.Equal(t, content, string(data))
+	assert.True(t, stream.closed)
+}
+
+func TestBrotliAuto(t *testing.T) {
+	large := strings.Repeat("this is a large response!\n", 1000)
+	h := server.Default(server.WithHostPorts("127.0.0.1:2340"))
+	h.Use(BrotliAuto(DefaultCompression, WithBufferSize(1024)))
+	h.GET("/small", func(ctx context.Context, c *app.RequestContext) {
+		c.String(200, testResponse)
+	})
+	h.GET("/large", func(ctx context.Context, c *app.RequestContext) {
+		_, _ = c.Write([]byte(large))
+	})
+	h.GET("/flush", func(ctx context.Context, c *app.RequestContext) {
+		_, _ = c.Write([]byte(testResponse))
+		_ = c.Flush()
+	})
+	go h.Spin()
+	time.Sleep(time.Second)
+
+	cli, err := client.NewClient(client.WithResponseBodyStream(true))
+	if err != nil {
+		panic(err)
+	}
+
+	for path, expected := range map[string]struct {
+		body    string
+		chunked bool
+	}{
+		"/small": {testResponse, false},
+		"/large": {large, true},
+		"/flush": {testResponse, true},
+	} {
+		req := protocol.AcquireRequest()
+		res := protocol.AcquireResponse()
+		req.SetRequestURI("http://127.0.0.1:2340" + path)
+		req.Header.Set("Accept-Encoding", "br")
+		if err = cli.Do(context.Background(), req, res); err != nil {
+			t.Fatalf("Get: %v", err)
+		}
+
+		assert.Equal(t, 200, res.StatusCode())
+		assert.Equal(t, "br", res.Header.Get("Content-Encoding"), path)
+		assert.Equal(t, "Accept-Encoding", res.Header.Get("Vary"), path)
+		if expected.chunked {
+			assert.Equal(t, "chunked", res.Header.Get("Transfer-Encoding"), path)
+		} else {
+			assert.Equal(t, "", res.Header.Get("Transfer-Encoding"), path)
+			assert.Less(t, 0, res.Header.ContentLength(), path)
+		}
+
+		data, err := io.ReadAll(brotli.NewReader(res.BodyStream()))
+		assert.Nil(t, err)
+		assert.Equal(t, expected.body, string(data), path)
+		_ = res.CloseBodyStream()
+	}
+}
+
+func TestStreamBrotliHTTP10(t *testing.T) {
+	h := server.Default(server.WithHostPorts("127.0.0.1:2341"))
+	h.Use(BrotliStream(DefaultCompression))
+	h.GET("/", func(ctx context.Context, c *app.RequestContext) {
+		_, _ = c.Write([]byte(testResponse))
+		_ = c.Flush()
+	})
+	go h.Spin()
+	time.Sleep(time.Second)
+
+	conn, err := net.Dial("tcp", "127.0.0.1:2341")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close() // nolint:errcheck
+	_, err = conn.Write([]byte("GET / HTTP/1.0\r\nHost: 127.0.0.1\r\nAccept-Encoding: br\r\n\r\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the body is delimited by the server closing the connection
+	res, err := http.ReadResponse(bufio.NewReader(conn), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close() // nolint:errcheck
+	assert.Equal(t, http.StatusOK, res.StatusCode)
+	assert.Equal(t, "br", res.Header.Get("Content-Encoding"))
+	assert.Empty(t, res.TransferEncoding)
+	assert.True(t, res.Close)
+
+	data, err := io.ReadAll(brotli.NewReader(res.Body))
+	assert.Nil(t, err)
+	assert.Equal(t, testResponse, string(data))
+}
+
+type recordWriter struct {
+	bytes.Buffer
+	finalized bool
+}
+
+func (rw *recordWriter) Flush() error {
+	return nil
+}
+
+func (rw *recordWriter) Finalize() error {
+	rw.finalized = true
+	return nil
+}
+
+func TestStreamBrotliProtocolWriter(t *testing.T) {
+	pw := &recordWriter{}
+	router := route.NewEngine(config.NewOptions([]config.Option{}))
+	// stands in for a writer installed before the middleware runs
+	router.Use(func(ctx context.Context, c *app.RequestContext) {
+		c.Response.HijackWriter(pw)
+	})
+	router.Use(BrotliStream(DefaultCompression, WithFlushPolicy(FlushPolicy{Newline: true})))
+	router.GET("/", func(ctx context.Context, c *app.RequestContext) {
+		_, _ = c.Write([]byte(testResponse))
+		_ = c.Flush()
+	})
+
+	c := router.NewContext()
+	c.Request.SetRequestURI("/")
+	c.Request.Header.Set("Accept-Encoding", "br")
+	router.ServeHTTP(context.Background(), c)
+	assert.False(t, pw.finalized)
+	// what the server does once the handler returned
+	assert.Nil(t, c.Response.GetHijackWriter().Finalize())
+	assert.True(t, pw.finalized)
+	assert.Equal(t, "br", c.Response.Header.Get("Content-Encoding"))
+	assert.Equal(t, "Accept-Encoding", c.Response.Header.Get("Vary"))
+
+	data, err := io.ReadAll(brotli.NewReader(&pw.Buffer))
+	assert.Nil(t, err)
+	assert.Equal(t, testResponse, string(data))
+}
+
+func TestStreamBrotliContentTypes(t *testing.T) {
+	for _, opt := range []Option{
+		WithIncludedContentTypes([]string{"application/json"}),
+		WithExcludedContentTypes([]string{"image/*"}),
+		WithPreset(PresetRealtime),
+	} {
+		router := route.NewEngine(config.NewOptions([]config.Option{}))
+		router.Use(func(ctx context.Context, c *app.RequestContext) {
+			c.Response.HijackWriter(&recordWriter{})
+		})
+		router.Use(BrotliStream(DefaultCompression, opt))
+		router.GET("/", func(ctx context.Context, c *app.RequestContext) {
+			c.SetContentType(c.Query("type"))
+			_, _ = c.Write([]byte(testResponse))
+			_ = c.Flush()
+		})
+
+		for contentType, encoding := range map[string]string{"application/json": "br", "image/png": ""} {
+			c := router.NewContext()
+			c.Request.SetRequestURI("/?type=" + contentType)
+			c.Request.Header.Set("Accept-Encoding", "br")
+			router.ServeHTTP(context.Background(), c)
+			assert.Nil(t, c.Response.GetHijackWriter().Finalize())
+			assert.Equal(t, encoding, c.Response.Header.Get("Content-Encoding"), contentType)
+		}
+	}
+}
+
+func TestStreamBrotliHTTP2(t *testing.T) {
+	for name, mw := range map[string]app.HandlerFunc{
+		"stream": BrotliStream(DefaultCompression),
+		"auto":   BrotliAuto(DefaultCompression),
+	} {
+		router := route.NewEngine(config.NewOptions([]config.Option{}))
+		router.Use(mw)
+		router.GET("/", func(ctx context.Context, c *app.RequestContext) {
+			_, _ = c.Write([]byte(testResponse))
+			_ = c.Flush()
+		})
+
+		// an HTTP/2 server frames the response itself, no HTTP/1 framing
+		// may end up in the body
+		c := router.NewContext()
+		c.Request.SetRequestURI("/")
+		c.Request.Header.SetProtocol(consts.HTTP20)
+		c.Request.Header.Set("Accept-Encoding", "br")
+		router.ServeHTTP(context.Background(), c)
+		assert.Nil(t, c.Response.GetHijackWriter(), name)
+		assert.Equal(t, "br", c.Response.Header.Get("Content-Encoding"), name)
+
+		data, err := io.ReadAll(brotli.NewReader(bytes.NewReader(c.Response.Body())))
+		assert.Nil(t, err, name)
+		assert.Equal(t, testResponse, string(data), name)
+	}
+}
+
+func TestStreamBrotliEventStream(t *testing.T) {
+	events := []string{"data: {\"id\":1}\n\n", "data: {\"id\":2}\n", "\n", "data: {\"id\":3}\n\n"}
+	received := make(chan struct{})
+	h := server.Default(server.WithHostPorts("127.0.0.1:2342"))
+	h.Use(BrotliStream(DefaultCompression, WithEventStream(true)))
+	h.GET("/events", func(ctx context.Context, c *app.RequestContext) {
+		c.SetContentType("text/event-stream")
+		for _, event := range events {
+			_, _ = c.Write([]byte(event))
+			if strings.HasSuffix(event, "\n\n") || event == "\n" {
+				// no c.Flush, the middleware flushes complete events
+				select {
+				case <-received:
+				case <-time.After(3 * time.Second):
+					return
+				}
+			}
+		}
+	})
+	go h.Spin()
+	time.Sleep(time.Second)
+
+	cli, _ := client.NewClient(client.WithResponseBodyStream(true))
+	req := protocol.AcquireRequest()
+	resp := protocol.AcquireResponse()
+	req.SetRequestURI("http://127.0.0.1:2342/events")
+	req.Header.Set("Accept", "text/event-stream")
+	req.Header.Set("Accept-Encoding", "br")
+	if err := cli.Do(context.Background(), req, resp); err != nil {
+		t.Fatalf("Get: %v", err)
+	}
+	defer resp.CloseBodyStream() // nolint:errcheck
+
+	assert.Equal(t, "br", resp.Header.Get("Content-Encoding"))
+	assert.Equal(t, "chunked", resp.Header.Get("Transfer-Encoding"))
+
+	// a single brotli stream, decoded without resetting the reader
+	r := brotli.NewReader(resp.BodyStream())
+	for _, event := range []string{events[0], events[1] + events[2], events[3]} {
+		data := make([]byte, len(event))
+		_, err := io.ReadFull(r, data)
+		if err != nil {
+			t.Fatal(err)
+		}
+		assert.Equal(t, event, string(data))
+		received <- struct{}{}
+	}
+	rest, err := io.ReadAll(r)
+	assert.Nil(t, err)
+	assert.Empty(t, rest)
+}
+
+type flushCounter struct {
+	recordWriter
+	mu      sync.Mutex
+	flushes int
+}
+
+func (fc *flushCounter) Flush() error {
+	fc.mu.Lock()
+	defer fc.mu.Unlock()
+	fc.flushes++
+	return nil
+}
+
+func (fc *flushCounter) count() int {
+	fc.mu.Lock()
+	defer fc.mu.Unlock()
+	return fc.flushes
+}
+
+func TestFlushPolicy(t *testing.T) {
+	fc := &flushCounter{}
+	w := newAutoFlushWriter(fc, FlushPolicy{Bytes: 10})
+	_, _ = w.Write([]byte("123456"))
+	assert.Equal(t, 0, fc.count())
+	_, _ = w.Write([]byte("123456"))
+	assert.Equal(t, 1, fc.count())
+
+	fc = &flushCounter{}
+	w = newAutoFlushWriter(fc, FlushPolicy{Newline: true})
+	_, _ = w.Write([]byte(`{"id":1}`))
+	assert.Equal(t, 0, fc.count())
+	_, _ = w.Write([]byte("\n"))
+	assert.Equal(t, 1, fc.count())
+
+	fc = &flushCounter{}
+	w = newAutoFlushWriter(fc, FlushPolicy{Idle: 20 * time.Millisecond})
+	_, _ = w.Write([]byte(`{"id":1}`))
+	assert.Equal(t, 0, fc.count())
+	time.Sleep(100 * time.Millisecond)
+	assert.Equal(t, 1, fc.count())
+	assert.Nil(t, w.Finalize())
+	assert.True(t, fc.finalized)
+}
+
+func TestStreamBrotliFlushPolicy(t *testing.T) {
+	records := []string{"{\"id\":1}\n", "{\"id\":2}\n", "{\"id\":3}\n"}
+	received := make(chan struct{})
+	h := server.Default(server.WithHostPorts("127.0.0.1:2343"))
+	h.Use(BrotliStream(DefaultCompression, WithFlushPolicy(FlushPolicy{Newline: true})))
+	h.GET("/records", func(ctx context.Context, c *app.RequestContext) {
+		c.SetContentType("application/x-ndjson")
+		for _, record := range records {
+			// no c.Flush, the policy flushes every record
+			_, _ = c.Write([]byte(record))
+			select {
+			case <-received:
+			case <-time.After(3 * time.Second):
+				return
+			}
+		}
+	})
+	go h.Spin()
+	time.Sleep(time.Second)
+
+	cli, _ := client.NewClient(client.WithResponseBodyStream(true))
+	req := protocol.AcquireRequest()
+	resp := protocol.AcquireResponse()
+	req.SetRequestURI("http://127.0.0.1:2343/records")
+	req.Header.Set("Accept-Encoding", "br")
+	if err := cli.Do(context.Background(), req, resp); err != nil {
+		t.Fatalf("Get: %v", err)
+	}
+	defer resp.CloseBodyStream() // nolint:errcheck
+	assert.Equal(t, "br", resp.Header.Get("Content-Encoding"))
+
+	r := brotli.NewReader(resp.BodyStream())
+	for _, record := range records {
+		data := make([]byte, len(record))
+		if _, err := io.ReadFull(r, data); err != nil {
+			t.Fatal(err)
+		}
+		assert.Equal(t, record, string(data))
+		received <- struct{}{}
+	}
+	rest, err := io.ReadAll(r)
+	assert.Nil(t, err)
+	assert.Empty(t, rest)
+}
+
+type failingWriter struct {
+	recordWriter
+}
+
+func (fw *failingWriter) Write(p []byte) (int, error) {
+	return 0, errors.New("connection reset")
+}
+
+func TestAsyncCompression(t *testing.T) {
+	pw := &recordWriter{}
+	sw := newBrotliStreamWriter(&protocol.Response{}, pw, brotli.WriterOptions{Quality: BestCompression})
+	sw.continuous = true
+	w := newAsyncWriter(sw, 2)
+
+	var expected strings.Builder
+	for i := range 100 {
+		record := fmt.Sprintf("record %d\n", i)
+		expected.WriteString(record)
+		_, err := w.Write([]byte(record))
+		assert.Nil(t, err)
+		if i%10 == 0 {
+			assert.Nil(t, w.Flush())
+		}
+	}
+	assert.Nil(t, w.Finalize())
+	assert.True(t, pw.finalized)
+
+	data, err := io.ReadAll(brotli.NewReader(&pw.Buffer))
+	assert.Nil(t, err)
+	assert.Equal(t, expected.String(), string(data))
+
+	fw := &failingWriter{}
+	w = newAsyncWriter(newBrotliStreamWriter(&protocol.Response{}, fw, brotli.WriterOptions{Quality: BestSpeed}), 1)
+	_, err = w.Write([]byte(testResponse))
+	assert.Nil(t, err)
+	assert.Eventually(t, func() bool {
+		_, err = w.Write([]byte(testResponse))
+		return err != nil
+	}, time.Second, 10*time.Millisecond)
+	assert.NotNil(t, w.Flush())
+	assert.NotNil(t, w.Finalize())
+	assert.False(t, fw.finalized)
+}
+
+func TestAsyncCompressionFlushFirst(t *testing.T) {
+	pw := &recordWriter{}
+	sw := newBrotliStreamWriter(&protocol.Response{}, pw, brotli.WriterOptions{Quality: DefaultCompression})
+	sw.continuous = true
+	w := newAsyncWriter(sw, 2)
+
+	// BrotliAuto flushes before the first write when it switches to streaming
+	assert.Nil(t, w.Flush())
+	_, err := w.Write([]byte(testResponse))
+	assert.Nil(t, err)
+	assert.Nil(t, w.Finalize())
+
+	_, err = w.Write([]byte(testResponse))
+	assert.Equal(t, errFinalized, err)
+	assert.Equal(t, errFinalized, w.Flush())
+	assert.Nil(t, w.Finalize())
+
+	data, err := io.ReadAll(brotli.NewReader(&pw.Buffer))
+	assert.Nil(t, err)
+	assert.Equal(t, testResponse, string(data))
+}
+
+func TestStreamBrotliAsync(t *testing.T) {
+	h := server.Default(server.WithHostPorts("127.0.0.1:2344"))
+	h.Use(BrotliStream(BestCompression, WithAsyncCompression(4)))
+	h.GET("/", func(ctx context.Context, c *app.RequestContext) {
+		for i := range 3 {
+			_, _ = c.Write([]byte(fmt.Sprintf("chunk %d: %s", i, strings.Repeat("hi~", i))))
+			_ = c.Flush()
+		}
+	})
+	go h.Spin()
+	time.Sleep(time.Second)
+
+	cli, _ := client.NewClient(client.WithResponseBodyStream(true))
+	req := protocol.AcquireRequest()
+	resp := protocol.AcquireResponse()
+	req.SetRequestURI("http://127.0.0.1:2344/")
+	req.Header.Set("Accept-Encoding", "br")
+	if err := cli.Do(context.Background(), req, resp); err != nil {
+		t.Fatalf("Get: %v", err)
+	}
+	defer resp.CloseBodyStream() // nolint:errcheck
+	assert.Equal(t, "br", resp.Header.Get("Content-Encoding"))
+
+	// every write is its own brotli stream, in the order it was written
+	bodyStream := resp.BodyStream()
+	r := brotli.NewReader(bodyStream)
+	for i := range 3 {
+		expected := fmt.Sprintf("chunk %d: %s", i, strings.Repeat("hi~", i))
+		data := make([]byte, len(expected))
+		if _, err := io.ReadFull(r, data); err != nil {
+			t.Fatal(err)
+		}
+		assert.Equal(t, expected, string(data))
+		_ = r.Reset(bodyStream)
+	}
+}
+
+func TestLimiter(t *testing.T) {
+	l := NewLimiter(1, 100)
+	release, ok := l.TryAcquire(60)
+	assert.True(t, ok)
+	_, ok = l.TryAcquire(10)
+	assert.False(t, ok)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	_, err := l.Acquire(ctx, 10)
+	cancel()
+	assert.NotNil(t, err)
+	_, err = l.Acquire(context.Background(), 200)
+	assert.NotNil(t, err)
+
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		release()
+	}()
+	release2, err := l.Acquire(context.Background(), 40)
+	assert.Nil(t, err)
+	encoders, memory := l.InUse()
+	assert.Equal(t, 1, encoders)
+	assert.Equal(t, int64(40), memory)
+	release2()
+	release2()
+	encoders, memory = l.InUse()
+	assert.Equal(t, 0, encoders)
+	assert.Equal(t, int64(0), memory)
+}
+
+func TestBrotliLimiter(t *testing.T) {
+	degrade := brotli.WriterOptions{Quality: BestSpeed}
+	l := NewLimiter(0, EncoderMemory(brotli.WriterOptions{Quality: BestCompression})+EncoderMemory(degrade))
+	var decisions []LimitDecision
+	router := route.NewEngine(config.NewOptions([]config.Option{}))
+	router.Use(Brotli(BestCompression, WithLimiter(l, LimitPolicy{
+		Wait:    10 * time.Millisecond,
+		Degrade: &degrade,
+		OnDecision: func(c *app.RequestContext, decision LimitDecision) {
+			decisions = append(decisions, decision)
+		},
+	})))
+	router.GET("/", func(ctx context.Context, c *app.RequestContext) {
+		c.String(200, testResponse)
+	})
+
+	perform := func() *protocol.Response {
+		return ut.PerformRequest(router, consts.MethodGet, "/", nil, ut.Header{
+			Key: "Accept-Encoding", Value: "br",
+		}).Result()
+	}
+
+	w := perform()
+	assert.Equal(t, "br", w.Header.Get("Content-Encoding"))
+
+	// a level 11 encoder in flight leaves room for a degraded one only
+	release, ok := l.TryAcquire(EncoderMemory(brotli.WriterOptions{Quality: BestCompression}))
+	assert.True(t, ok)
+	w = perform()
+	assert.Equal(t, "br", w.Header.Get("Content-Encoding"))
+
+	releaseDegraded, ok := l.TryAcquire(EncoderMemory(degrade))
+	assert.True(t, ok)
+	w = perform()
+	assert.Equal(t, "", w.Header.Get("Content-Encoding"))
+	assert.Equal(t, "", w.Header.Get("Vary"))
+	assert.Equal(t, testResponse, string(w.Body()))
+	release()
+	releaseDegraded()
+
+	assert.Equal(t, []LimitDecision{LimitAcquired, LimitDegraded, LimitIdentity}, decisions)
+	encoders, _ := l.InUse()
+	assert.Equal(t, 0, encoders)
+}
+
+func TestLimiterCompressionLevel(t *testing.T) {
+	// room for the encoder of the middleware, not for that of the handler
+	l := NewLimiter(0, EncoderMemory(brotli.WriterOptions{Quality: BestSpeed}))
+	var memory int64
+	router := route.NewEngine(config.NewOptions([]config.Option{}))
+	router.Use(Brotli(BestSpeed, WithLimiter(l, LimitPolicy{
+		OnDecision: func(c *app.RequestContext, decision LimitDecision) {
+			_, memory = l.InUse()
+		},
+	})))
+	router.GET("/", func(ctx context.Context, c *app.RequestContext) {
+		if c.Query("level") != "" {
+			_ = SetCompressionLevel(c, BestCompression)
+		}
+		c.String(200, testResponse)
+	})
+
+	w := ut.PerformRequest(router, consts.MethodGet, "/", nil, ut.Header{
+		Key: "Accept-Encoding", Value: "br",
+	}).Result()
+	assert.Equal(t, "br", w.Header.Get("Content-Encoding"))
+	assert.Equal(t, EncoderMemory(brotli.WriterOptions{Quality: BestSpeed}), memory)
+
+	w = ut.PerformRequest(router, consts.MethodGet, "/?level=11", nil, ut.Header{
+		Key: "Accept-Encoding", Value: "br",
+	}).Result()
+	assert.Equal(t, "", w.Header.Get("Content-Encoding"))
+	assert.Equal(t, testResponse, string(w.Body()))
+}
+
+func TestStreamBrotliLimiter(t *testing.T) {
+	l := NewLimiter(1, 0)
+	serve := func() (*app.RequestContext, *recordWriter) {
+		pw := &recordWriter{}
+		router := route.NewEngine(config.NewOptions([]config.Option{}))
+		router.Use(func(ctx context.Context, c *app.RequestContext) {
+			c.Response.HijackWriter(pw)
+		})
+		router.Use(BrotliStream(DefaultCompression, WithLimiter(l, LimitPolicy{})))
+		router.GET("/", func(ctx context.Context, c *app.RequestContext) {
+			_, _ = c.Write([]byte(testResponse))
+			_ = c.Flush()
+		})
+		c := router.NewContext()
+		c.Request.SetRequestURI("/")
+		c.Request.Header.Set("Accept-Encoding", "br")
+		router.ServeHTTP(context.Background(), c)
+		return c, pw
+	}
+
+	// the encoder holds the budget until the response is finalized
+	first, _ := serve()
+	assert.Equal(t, "br", first.Response.Header.Get("Content-Encoding"))
+	encoders, _ := l.InUse()
+	assert.Equal(t, 1, encoders)
+
+	second, pw := serve()
+	assert.Equal(t, "", second.Response.Header.Get("Content-Encoding"))
+	assert.Nil(t, second.Response.GetHijackWriter().Finalize())
+	assert.Equal(t, testResponse, pw.String())
+
+	assert.Nil(t, first.Response.GetHijackWriter().Finalize())
+	encoders, _ = l.InUse()
+	assert.Equal(t, 0, encoders)
+}
+
+func TestCompressionTimeout(t *testing.T) {
+	router := route.NewEngine(config.NewOptions([]config.Option{}))
+	router.Use(Brotli(BestCompression, WithCompressionTimeout(time.Nanosecond)))
+	router.GET("/", func(ctx context.Context, c *app.RequestContext) {
+		c.String(200, testResponse)
+	})
+	w := ut.PerformRequest(router, consts.MethodGet, "/", nil, ut.Header{
+		Key: "Accept-Encoding", Value: "br",
+	}).Result()
+	assert.Equal(t, http.StatusOK, w.StatusCode())
+	assert.Equal(t, "", w.Header.Get("Content-Encoding"))
+	assert.Equal(t, testResponse, string(w.Body()))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err := compress(ctx, []byte(testResponse), brotli.WriterOptions{Quality: BestCompression})
+	assert.Equal(t, context.Canceled, err)
+
+	r := newBrotliCompressReader(strings.NewReader(testResponse), brotli.WriterOptions{Quality: BestCompression})
+	r.ctx = ctx
+	_, err = io.ReadAll(r)
+	assert.Equal(t, context.Canceled, err)
+}
+
+func TestIdentityFallback(t *testing.T) {
+	random := make([]byte, 4096)
+	_, _ = rand.Read(random)
+
+	router := route.NewEngine(config.NewOptions([]config.Option{}))
+	router.Use(Brotli(DefaultCompression, WithIdentityFallback(0.5)))
+	router.GET("/random", func(ctx context.Context, c *app.RequestContext) {
+		c.Data(200, "application/octet-stream", random)
+	})
+	router.GET("/", func(ctx context.Context, c *app.RequestContext) {
+		c.String(200, strings.Repeat(testResponse, 100))
+	})
+	w := ut.PerformRequest(router, consts.MethodGet, "/random", nil, ut.Header{
+		Key: "Accept-Encoding", Value: "br",
+	}).Result()
+	assert.Equal(t, "", w.Header.Get("Content-Encoding"))
+	assert.Equal(t, random, w.Body())
+
+	w = ut.PerformRequest(router, consts.MethodGet, "/", nil, ut.Header{
+		Key: "Accept-Encoding", Value: "br",
+	}).Result()
+	assert.Equal(t, "br", w.Header.Get("Content-Encoding"))
+
+	// the test response compresses, but by less than 90%
+	router = route.NewEngine(config.NewOptions([]config.Option{}))
+	router.Use(Brotli(DefaultCompression, WithIdentityFallback(0.9)))
+	router.GET("/", func(ctx context.Context, c *app.RequestContext) {
+		c.String(200, testResponse+" "+testResponse)
+	})
+	w = ut.PerformRequest(router, consts.MethodGet, "/", nil, ut.Header{
+		Key: "Accept-Encoding", Value: "br",
+	}).Result()
+	assert.Equal(t, "", w.Header.Get("Content-Encoding"))
+
+	_, err := NewBrotli(DefaultCompression, WithIdentityFallback(1))
+	assert.NotNil(t, err)
+
+	mw, err := newBrotliCliMiddleware(DefaultCompression, WithClientIdentityFallback(0))
+	assert.Nil(t, err)
+	var sent []byte
+	next := func(ctx context.Context, req *protocol.Request, resp *protocol.Response) error {
+		sent = append([]byte(nil), req.Body()...)
+		return nil
+	}
+	req := protocol.AcquireRequest()
+	req.SetBody(random)
+	assert.Nil(t, mw.Handle(next)(context.Background(), req, protocol.AcquireResponse()))
+	assert.Equal(t, "", req.Header.Get("Content-Encoding"))
+	assert.Equal(t, random, sent)
+}
+
+func TestProbe(t *testing.T) {
+	random := make([]byte, 8192)
+	_, _ = rand.Read(random)
+	assert.Greater(t, entropy(random), 7.5)
+	assert.Less(t, entropy([]byte(strings.Repeat(testResponse, 100))), 5.0)
+
+	router := route.NewEngine(config.NewOptions([]config.Option{}))
+	router.Use(Brotli(DefaultCompression, WithProbe(Probe{})))
+	router.GET("/random", func(ctx context.Context, c *app.RequestContext) {
+		_, _ = c.Write(random)
+	})
+	router.GET("/text", func(ctx context.Context, c *app.RequestContext) {
+		_, _ = c.Write([]byte(strings.Repeat(testResponse, 100)))
+	})
+	router.GET("/typed", func(ctx context.Context, c *app.RequestContext) {
+		c.Data(200, "image/x-custom", random)
+	})
+	for path, encoding := range map[string]string{"/random": "", "/text": "br", "/typed": "br"} {
+		w := ut.PerformRequest(router, consts.MethodGet, path, nil, ut.Header{
+			Key: "Accept-Encoding", Value: "br",
+		}).Result()
+		assert.Equal(t, encoding, w.Header.Get("Content-Encoding"), path)
+	}
+}
+
+func TestContentTypeSniffing(t *testing.T) {
+	png := append([]byte("\x89PNG\x0D\x0A\x1A\x0A"), bytes.Repeat([]byte{0}, 1024)...)
+	html := []byte("<!DOCTYPE html><html>" + strings.Repeat(testResponse, 100) + "</html>")
+
+	for _, setHeader := range []bool{false, true} {
+		router := route.NewEngine(config.NewOptions([]config.Option{}))
+		router.Use(Brotli(DefaultCompression,
+			WithContentTypeSniffing(setHeader),
+			WithExcludedContentTypes([]string{"image/*"}),
+		))
+		router.GET("/png", func(ctx context.Context, c *app.RequestContext) {
+			_, _ = c.Write(png)
+		})
+		router.GET("/html", func(ctx context.Context, c *app.RequestContext) {
+			_, _ = c.Write(html)
+		})
+
+		w := ut.PerformRequest(router, consts.MethodGet, "/png", nil, ut.Header{
+			Key: "Accept-Encoding", Value: "br",
+		}).Result()
+		assert.Equal(t, "", w.Header.Get("Content-Encoding"))
+		assert.Equal(t, png, w.Body())
+
+		w = ut.PerformRequest(router, consts.MethodGet, "/html", nil, ut.Header{
+			Key: "Accept-Encoding", Value: "br",
+		}).Result()
+		assert.Equal(t, "br", w.Header.Get("Content-Encoding"))
+		if setHeader {
+			assert.Equal(t, "text/html; charset=utf-8", string(w.Header.ContentType()))
+		} else {
+			assert.Equal(t, "text/plain; charset=utf-8", string(w.Header.ContentType()))
+		}
+	}
+}
+
+func TestPathPatterns(t *testing.T) {
+	patterns := NewPathPatterns([]string{"/api/:id/raw", "/files/*rest", "/static/*.js"})
+	assert.True(t, patterns.Contains("/api/42/raw"))
+	assert.False(t, patterns.Contains("/api/42/raw/more"))
+	assert.False(t, patterns.Contains("/api//raw"))
+	assert.True(t, patterns.Contains("/files/a/b/c"))
+	assert.True(t, patterns.Contains("/files/"))
+	assert.False(t, patterns.Contains("/files"))
+	assert.False(t, patterns.Contains("/api/42/raw/"))
+	assert.False(t, NewPathPatterns([]string{"/api/:id/*rest"}).Contains("/api/1"))
+	assert.True(t, NewPathPatterns([]string{"/api/:id/*rest"}).Contains("/api/1/"))
+
+	// the patterns agree with the router
+	router := route.NewEngine(config.NewOptions([]config.Option{}))
+	router.GET("/api/:id/*rest", func(ctx context.Context, c *app.RequestContext) {})
+	rest := NewPathPatterns([]string{"/api/:id/*rest"})
+	for _, uri := range []string{"/api/1", "/api/1/", "/api/1/a/b", "/api//x"} {
+		w := ut.PerformRequest(router, consts.MethodGet, uri, nil).Result()
+		assert.Equal(t, w.StatusCode() == http.StatusOK, rest.Contains(uri), uri)
+	}
+	assert.True(t, patterns.Contains("/static/app.js"))
+	assert.False(t, patterns.Contains("/static/js/app.js"))
+	assert.Panics(t, func() { NewPathPatterns([]string{"/static/[.js"}) })
+	_, err := NewBrotli(DefaultCompression, WithExcludedPathPatterns([]string{"/static/[.js"}))
+	assert.NotNil(t, err)
+	_, err = NewBrotliClient(DefaultCompression, WithClientExcludedPathPatterns([]string{"/static/[.js"}))
+	assert.NotNil(t, err)
+	assert.Panics(t, func() { BrotliClient(DefaultCompression, WithClientExcludedPathPatterns([]string{"/static/[.js"})) })
+
+	assert.True(t, NewExcludedExtensions([]string{".PNG"}).Contains(".png"))
+	assert.True(t, NewExcludedPaths([]string{"/Static"}).Contains("/static/a.js"))
+
+	router = route.NewEngine(config.NewOptions([]config.Option{}))
+	router.Use(Brotli(DefaultCompression, WithExcludedPathPatterns([]string{"/files/*rest"})))
+	handler := func(ctx context.Context, c *app.RequestContext) {
+		c.String(200, testResponse)
+	}
+	router.GET("/img/:name", handler)
+	router.GET("/files/*rest", handler)
+	router.GET("/", handler)
+	for uri, encoding := range map[string]string{
+		"/img/a.png?v=2":  "",
+		"/img/a.PNG":      "",
+		"/files/a/b.txt":  "",
+		"/?q=/files/x":    "br",
+		"/img/a.txt?x=.p": "br",
+	} {
+		w := ut.PerformRequest(router, consts.MethodGet, uri, nil, ut.Header{
+			Key: "Accept-Encoding", Value: "br",
+		}).Result()
+		assert.Equal(t, encoding, w.Header.Get("Content-Encoding"), uri)
+	}
+}
+
+func TestRoutes(t *testing.T) {
+	router := route.NewEngine(config.NewOptions([]config.Option{}))
+	router.Use(Brotli(DefaultCompression,
+		WithExcludedRoutes([]string{"/users/:id/avatar"}),
+		WithRouteOptions("/reports/:id", WithMinLength(1024)),
+	))
+	handler := func(ctx context.Context, c *app.RequestContext) {
+		c.String(200, testResponse)
+	}
+	router.GET("/users/:id", handler)
+	router.GET("/users/:id/avatar", handler)
+	router.GET("/reports/:id", handler)
+	for uri, encoding := range map[string]string{
+		"/users/1":        "br",
+		"/users/1/avatar": "",
+		"/reports/1":      "",
+	} {
+		w := ut.PerformRequest(router, consts.MethodGet, uri, nil, ut.Header{
+			Key: "Accept-Encoding", Value: "br",
+		}).Result()
+		assert.Equal(t, encoding, w.Header.Get("Content-Encoding"), uri)
+	}
+
+	router = route.NewEngine(config.NewOptions([]config.Option{}))
+	router.Use(Brotli(DefaultCompression, WithIncludedRoutes([]string{"/users/:id"})))
+	router.GET("/users/:id", handler)
+	router.GET("/reports/:id", handler)
+	for uri, encoding := range map[string]string{
+		"/users/1":   "br",
+		"/reports/1": "",
+	} {
+		w := ut.PerformRequest(router, consts.MethodGet, uri, nil, ut.Header{
+			Key: "Accept-Encoding", Value: "br",
+		}).Result()
+		assert.Equal(t, encoding, w.Header.Get("Content-Encoding"), uri)
+	}
+
+	_, err := NewBrotli(DefaultCompression, WithRouteOptions("/", WithIdentityFallback(2)))
+	assert.NotNil(t, err)
+}
+
+func TestIncludedPaths(t *testing.T) {
+	router := route.NewEngine(config.NewOptions([]config.Option{}))
+	router.Use(Brotli(DefaultCompression,
+		WithIncludedPaths([]string{"/api/"}),
+		WithIncludedPathRegexes([]string{`^/pages/\d+`}),
+		WithIncludedExtensions([]string{".json", ".html"}),
+		WithExcludedPaths([]string{"/api/private/"}),
+	))
+	router.GET("/*path", func(ctx context.Context, c *app.RequestContext) {
+		c.String(200, testResponse)
+	})
+	for uri, encoding := range map[string]string{
+		"/api/a.json":         "br",
+		"/pages/1/index.html": "br",
+		"/api/a.txt":          "",
+		"/other/a.json":       "",
+		"/api/private/a.json": "",
+	} {
+		w := ut.PerformRequest(router, consts.MethodGet, uri, nil, ut.Header{
+			Key: "Accept-Encoding", Value: "br",
+		}).Result()
+		assert.Equal(t, encoding, w.Header.Get("Content-Encoding"), uri)
+	}
+
+	mw, err := newBrotliCliMiddleware(DefaultCompression, WithClientIncludedExtensions([]string{".json"}))
+	assert.Nil(t, err)
+	req := protocol.AcquireRequest()
+	req.SetRequestURI("http://127.0.0.1/a.json")
+	assert.True(t, mw.shouldCompress(req))
+	req.SetRequestURI("http://127.0.0.1/a.txt")
+	assert.False(t, mw.shouldCompress(req))
+
+	_, err = ParseJSONConfig([]byte(`{"included_extensions": ["json"], "included_paths": ["api"]}`))
+	assert.NotNil(t, err)
+}
+
+func TestPathMatchers(t *testing.T) {
+	// the public slices and the compiled matchers agree
+	paths := NewExcludedPaths([]string{"/api/", "/API/v2", "/static", "/Ärger"})
+	compiled := compilePaths(paths)
+	for uri, match := range map[string]bool{
+		"/api/books": true,
+		"/Api/v2/x":  true,
+		"/static":    true,
+		"/ap":        false,
+		// only ASCII letters are folded
+		"/Ärger/x": true,
+		"/äRGER/x": false,
+	} {
+		assert.Equal(t, match, paths.Contains(uri), uri)
+		assert.Equal(t, match, compiled.Contains(uri), uri)
+	}
+	assert.False(t, compilePaths(ExcludedPaths{}).Contains("/"))
+	assert.False(t, compilePaths(nil).Contains("/"))
+
+	regexes := append(NewExcludedPathRegexes([]string{`^/secret/.*$`, `^(?i)/admin`, `\.map$`}),
+		regexp.MustCompile(`^/a|^/b`))
+	compiledRegexes := compileRegexes(regexes)
+	for uri, match := range map[string]bool{
+		"/secret/x":   true,
+		"/ADMIN/x":    true,
+		"/js/app.map": true,
+		"/b/c":        true,
+		"/public":     false,
+		"/secretly":   false,
+	} {
+		assert.Equal(t, match, regexes.Contains(uri), uri)
+		assert.Equal(t, match, compiledRegexes.Contains(uri), uri)
+	}
+	assert.False(t, compileRegexes(nil).Contains("/"))
+	assert.Panics(t, func() { NewExcludedPathRegexes([]string{`(`}) })
+	_, err := NewBrotli(DefaultCompression, WithIncludedPathRegexes([]string{`(`}))
+	assert.NotNil(t, err)
+	_, err = NewBrotliClient(DefaultCompression, WithClientExcludedPathRegexes([]string{`(`}))
+	assert.NotNil(t, err)
+
+	prefix, ok := anchoredPrefix(`^/api/v\d+`)
+	assert.True(t, ok)
+	assert.Equal(t, "/api/v", prefix)
+	_, ok = anchoredPrefix(`/api/`)
+	assert.False(t, ok)
+}
+
+func BenchmarkExcludedPaths(b *testing.B) {
+	for _, n := range []int{10, 100, 1000, 10000} {
+		rules := make([]string, n)
+		for i := range rules {
+			rules[i] = fmt.Sprintf("/service%d/v1/", i)
+		}
+		paths := compilePaths(NewExcludedPaths(rules))
+		b.Run(strconv.Itoa(n), func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				paths.Contains("/service/v1/users/42")
+			}
+		})
+	}
+}
+
+func BenchmarkExcludedPathRegexes(b *testing.B) {
+	for _, rule := range []struct {
+		name   string
+		format string
+	}{
+		{"anchored", `^/service%d/v\d+/`},
+		// merged into one regex, which grows with the rules
+		{"unanchored", `/service%d/v\d+/`},
+	} {
+		for _, n := range []int{10, 100, 1000} {
+			rules := make([]string, n)
+			for i := range rules {
+				rules[i] = fmt.Sprintf(rule.format, i)
+			}
+			regexes := compileRegexes(NewExcludedPathRegexes(rules))
+			b.Run(rule.name+"/"+strconv.Itoa(n), func(b *testing.B) {
+				for i := 0; i < b.N; i++ {
+					regexes.Contains("/service/v1/users/42")
+				}
+			})
+		}
+	}
+}
+
+func TestMethodsAndStatusCodes(t *testing.T) {
+	router := route.NewEngine(config.NewOptions([]config.Option{}))
+	router.Use(Brotli(DefaultCompression, WithMethods([]string{"get", "POST"}), WithStatusCodes([]string{"2xx", "404"})))
+	handler := func(ctx context.Context, c *app.RequestContext) {
+		code, _ := strconv.Atoi(c.Query("code"))
+		c.String(code, testResponse)
+	}
+	router.GET("/", handler)
+	router.OPTIONS("/", handler)
+	for _, tc := range []struct {
+		method, uri, encoding string
+	}{
+		{consts.MethodGet, "/?code=200", "br"},
+		{consts.MethodGet, "/?code=404", "br"},
+		{consts.MethodGet, "/?code=500", ""},
+		{consts.MethodGet, "/?code=302", ""},
+		{consts.MethodOptions, "/?code=200", ""},
+	} {
+		w := ut.PerformRequest(router, tc.method, tc.uri, nil, ut.Header{
+			Key: "Accept-Encoding", Value: "br",
+		}).Result()
+		assert.Equal(t, tc.encoding, w.Header.Get("Content-Encoding"), tc.method+" "+tc.uri)
+	}
+
+	codes := NewStatusCodes([]string{"200-206", "3XX"})
+	assert.True(t, codes.Contains(206))
+	assert.True(t, codes.Contains(304))
+	assert.False(t, codes.Contains(207))
+	assert.Panics(t, func() { NewStatusCodes([]string{"2x"}) })
+	assert.Panics(t, func() { NewStatusCodes([]string{"299-200"}) })
+	_, err := NewBrotli(DefaultCompression, WithStatusCodes([]string{"abc"}))
+	assert.NotNil(t, err)
+	assert.Panics(t, func() { Brotli(DefaultCompression, WithStatusCodes([]string{"abc"})) })
+
+	// streamed responses decide at the first write
+	pw := &recordWriter{}
+	router = route.NewEngine(config.NewOptions([]config.Option{}))
+	router.Use(func(ctx context.Context, c *app.RequestContext) {
+		c.Response.HijackWriter(pw)
+	})
+	router.Use(BrotliStream(DefaultCompression, WithStatusCodes([]string{"2xx"})))
+	router.GET("/", func(ctx context.Context, c *app.RequestContext) {
+		c.Status(http.StatusInternalServerError)
+		_, _ = c.Write([]byte(testResponse))
+		_ = c.Flush()
+	})
+	w := ut.PerformRequest(router, consts.MethodGet, "/", nil, ut.Header{
+		Key: "Accept-Encoding", Value: "br",
+	}).Result()
+	assert.Equal(t, "", w.Header.Get("Content-Encoding"))
+	assert.Equal(t, testResponse, pw.String())
+}
+
+func TestClientMethods(t *testing.T) {
+	var sent *protocol.Request
+	next := func(ctx context.Context, req *protocol.Request, resp *protocol.Response) error {
+		sent = req
+		return nil
+	}
+
+	mw, err := newBrotliCliMiddleware(DefaultCompression)
+	assert.Nil(t, err)
+	for method, encoding := range map[string]string{
+		consts.MethodGet:    "",
+		consts.MethodDelete: "",
+		consts.MethodPost:   "br",
+	} {
+		req := protocol.AcquireRequest()
+		req.Header.SetMethod(method)
+		assert.Nil(t, mw.Handle(next)(context.Background(), req, protocol.AcquireResponse()))
+		assert.Equal(t, encoding, sent.Header.Get("Content-Encoding"), method)
+	}
+
+	mw, err = newBrotliCliMiddleware(DefaultCompression, WithClientMethods([]string{consts.MethodPut}))
+	assert.Nil(t, err)
+	req := protocol.AcquireRequest()
+	req.Header.SetMethod(consts.MethodPost)
+	req.SetBodyString(testResponse)
+	assert.Nil(t, mw.Handle(next)(context.Background(), req, protocol.AcquireResponse()))
+	assert.Equal(t, "", sent.Header.Get("Content-Encoding"))
+	assert.Equal(t, testResponse, string(sent.Body()))
+}
+
+func TestCompressionControl(t *testing.T) {
+	router := route.NewEngine(config.NewOptions([]config.Option{}))
+	router.Use(Brotli(DefaultCompression, WithMinLength(1024), WithCache(NewResponseCache(1<<20, 0))))
+	router.GET("/disable", func(ctx context.Context, c *app.RequestContext) {
+		DisableCompression(c)
+		c.String(200, strings.Repeat(testResponse, 100))
+	})
+	router.GET("/force", func(ctx context.Context, c *app.RequestContext) {
+		ForceCompression(c)
+		c.String(200, testResponse)
+	})
+	router.GET("/level", func(ctx context.Context, c *app.RequestContext) {
+		assert.NotNil(t, SetCompressionLevel(c, 12))
+		assert.Nil(t, SetCompressionLevel(c, BestCompression))
+		c.String(200, strings.Repeat(testResponse, 100))
+	})
+	for path, encoding := range map[string]string{"/disable": "", "/force": "br", "/level": "br"} {
+		w := ut.PerformRequest(router, consts.MethodGet, path, nil, ut.Header{
+			Key: "Accept-Encoding", Value: "br",
+		}).Result()
+		assert.Equal(t, encoding, w.Header.Get("Content-Encoding"), path)
+		if encoding == "br" {
+			data, err := io.ReadAll(brotli.NewReader(bytes.NewReader(w.Body())))
+			assert.Nil(t, err)
+			assert.True(t, strings.HasPrefix(string(data), testResponse), path)
+		}
+	}
+
+	// streamed responses read the decision at the first write
+	pw := &recordWriter{}
+	router = route.NewEngine(config.NewOptions([]config.Option{}))
+	router.Use(func(ctx context.Context, c *app.RequestContext) {
+		c.Response.HijackWriter(pw)
+	})
+	router.Use(BrotliStream(DefaultCompression))
+	router.GET("/", func(ctx context.Context, c *app.RequestContext) {
+		DisableCompression(c)
+		_, _ = c.Write([]byte(testResponse))
+		_ = c.Flush()
+	})
+	w := ut.PerformRequest(router, consts.MethodGet, "/", nil, ut.Header{
+		Key: "Accept-Encoding", Value: "br",
+	}).Result()
+	assert.Equal(t, "", w.Header.Get("Content-Encoding"))
+	assert.Equal(t, testResponse, pw.String())
+}
+
+func TestPreEncodedBody(t *testing.T) {
+	body := strings.Repeat(testResponse, 100)
+	var buf bytes.Buffer
+	bw := brotli.NewWriter(&buf)
+	_, _ = bw.Write([]byte(body))
+	_ = bw.Close()
+	encoded := buf.Bytes()
+
+	for name, mw := range map[string]app.HandlerFunc{
+		"buffered": Brotli(DefaultCompression),
+		"stream":   BrotliStream(DefaultCompression),
+		"auto":     BrotliAuto(DefaultCompression),
+	} {
+		router := route.NewEngine(config.NewOptions([]config.Option{}))
+		router.Use(mw)
+		router.GET("/", func(ctx context.Context, c *app.RequestContext) {
+			SetBrotliBody(c, encoded)
+		})
+
+		w := ut.PerformRequest(router, consts.MethodGet, "/", nil, ut.Header{
+			Key: "Accept-Encoding", Value: "br",
+		}).Result()
+		assert.Equal(t, "br", w.Header.Get("Content-Encoding"), name)
+		assert.Equal(t, encoded, w.Body(), name)
+
+		w = ut.PerformRequest(router, consts.MethodGet, "/", nil, ut.Header{
+			Key: "Accept-Encoding", Value: "gzip",
+		}).Result()
+		assert.Equal(t, "", w.Header.Get("Content-Encoding"), name)
+		assert.Equal(t, body, string(w.Body()), name)
+	}
+}
+
+func TestPreEncodedBodyAsync(t *testing.T) {
+	var buf bytes.Buffer
+	bw := brotli.NewWriter(&buf)
+	_, _ = bw.Write([]byte(testResponse))
+	_ = bw.Close()
+	encoded := buf.Bytes()
+
+	router := route.NewEngine(config.NewOptions([]config.Option{}))
+	router.Use(BrotliStream(DefaultCompression, WithAsyncCompression(4)))
+	router.GET("/", func(ctx context.Context, c *app.RequestContext) {
+		SetBrotliBody(c, encoded)
+	})
+
+	// the replaced writer was never written to, it must not keep a goroutine
+	before := runtime.NumGoroutine()
+	for range 10 {
+		w := ut.PerformRequest(router, consts.MethodGet, "/", nil, ut.Header{
+			Key: "Accept-Encoding", Value: "br",
+		}).Result()
+		assert.Equal(t, encoded, w.Body())
+	}
+	assert.LessOrEqual(t, runtime.NumGoroutine(), before)
+
+	// nor block Finalize
+	w := newAsyncWriter(newBrotliStreamWriter(&protocol.Response{}, &recordWriter{}, brotli.WriterOptions{}), 1)
+	assert.Nil(t, w.Finalize())
+}
+
+func TestDecompress(t *testing.T) {
+	var buf bytes.Buffer
+	bw := brotli.NewWriter(&buf)
+	_, _ = bw.Write([]byte(strings.Repeat(testResponse, 100)))
+	_ = bw.Close()
+	encoded := buf.Bytes()
+
+	router := route.NewEngine(config.NewOptions([]config.Option{}))
+	router.Use(Decompress(WithMaxBodySize(1024), WithDecompressPaths([]string{"/upload"})))
+	handler := func(ctx context.Context, c *app.RequestContext) {
+		c.String(200, strconv.Itoa(len(c.Request.Body())))
+	}
+	router.POST("/upload", handler)
+	router.POST("/other", handler)
+
+	for _, tc := range []struct {
+		uri  string
+		body []byte
+		code int
+		resp string
+	}{
+		{"/upload", encoded[:len(encoded)/2], http.StatusBadRequest, ""},
+		{"/upload", encoded, http.StatusRequestEntityTooLarge, ""},
+		{"/other", encoded, http.StatusOK, strconv.Itoa(len(encoded))},
+	} {
+		w := ut.PerformRequest(router, consts.MethodPost, tc.uri, &ut.Body{Body: bytes.NewReader(tc.body), Len: len(tc.body)}, ut.Header{
+			Key: "Content-Encoding", Value: "br",
+		}).Result()
+		assert.Equal(t, tc.code, w.StatusCode(), tc.uri)
+		if tc.resp != "" {
+			assert.Equal(t, tc.resp, string(w.Body()), tc.uri)
+		}
+	}
+
+	router = route.NewEngine(config.NewOptions([]config.Option{}))
+	router.Use(Decompress(WithMaxBodySize(len(testResponse)*100 - 1)))
+	router.POST("/", handler)
+	w := ut.PerformRequest(router, consts.MethodPost, "/", &ut.Body{Body: bytes.NewReader(encoded), Len: len(encoded)}, ut.Header{
+		Key: "Content-Encoding", Value: "br",
+	}).Result()
+	assert.Equal(t, http.StatusRequestEntityTooLarge, w.StatusCode())
+
+	router = route.NewEngine(config.NewOptions([]config.Option{}))
+	router.Use(Decompress(WithDecompressErrorHandler(func(ctx context.Context, c *app.RequestContext, err error) {
+		c.AbortWithStatusJSON(http.StatusUnprocessableEntity, map[string]string{"error": err.Error()})
+	})))
+	router.POST("/", handler)
+	w = ut.PerformRequest(router, consts.MethodPost, "/", &ut.Body{Body: bytes.NewReader(encoded), Len: len(encoded)}, ut.Header{
+		Key: "Content-Encoding", Value: "br",
+	}).Result()
+	assert.Equal(t, http.StatusOK, w.StatusCode())
+	assert.Equal(t, strconv.Itoa(len(testResponse)*100), string(w.Body()))
+	w = ut.PerformRequest(router, consts.MethodPost, "/", &ut.Body{Body: bytes.NewReader([]byte("not brotli")), Len: 10}, ut.Header{
+		Key: "Content-Encoding", Value: "br",
+	}).Result()
+	assert.Equal(t, http.StatusUnprocessableEntity, w.StatusCode())
+
+	_, err := NewDecompress(WithDecompressWindow(30))
+	assert.NotNil(t, err)
+}
+
+func TestDecompressZstdWindow(t *testing.T) {
+	// a frame declaring a 2^29 window with a single raw byte
+	frame := []byte{0x28, 0xb5, 0x2f, 0xfd, 0x00, 19 << 3, 0x09, 0x00, 0x00, 'a'}
+	small := encodeZstd(t, []byte(strings.Repeat(testResponse, 100)))
+
+	for _, tc := range []struct {
+		opts []DecompressOption
+		body []byte
+		code int
+	}{
+		{nil, frame, http.StatusBadRequest},
+		{[]DecompressOption{WithDecompressWindow(24)}, frame, http.StatusBadRequest},
+		{[]DecompressOption{WithMaxBodySize(1024)}, frame, http.StatusBadRequest},
+		{nil, small, http.StatusOK},
+		{[]DecompressOption{WithMaxBodySize(1024)}, small, http.StatusRequestEntityTooLarge},
+	} {
+		router := route.NewEngine(config.NewOptions([]config.Option{}))
+		router.Use(Decompress(tc.opts...))
+		router.POST("/", func(ctx context.Context, c *app.RequestContext) {})
+		w := ut.PerformRequest(router, consts.MethodPost, "/", &ut.Body{Body: bytes.NewReader(tc.body), Len: len(tc.body)}, ut.Header{
+			Key: "Content-Encoding", Value: "zstd",
+		}).Result()
+		assert.Equal(t, tc.code, w.StatusCode())
+	}
+}
+
+func encodeZstd(t *testing.T, data []byte) []byte {
+	var buf bytes.Buffer
+	w, err := zstd.NewWriter(&buf)
+	assert.Nil(t, err)
+	_, _ = w.Write(data)
+	assert.Nil(t, w.Close())
+	return buf.Bytes()
+}
+
+func TestDecompressCodings(t *testing.T) {
+	encode := func(coding string, data []byte) []byte {
+		var buf bytes.Buffer
+		var w io.WriteCloser
+		switch coding {
+		case "br":
+			w = brotli.NewWriter(&buf)
+		case "gzip":
+			w = gzip.NewWriter(&buf)
+		case "deflate":
+			w = zlib.NewWriter(&buf)
+		case "zstd":
+			w, _ = zstd.NewWriter(&buf)
+		}
+		_, _ = w.Write(data)
+		_ = w.Close()
+		return buf.Bytes()
+	}
+
+	router := route.NewEngine(config.NewOptions([]config.Option{}))
+	router.Use(Brotli(DefaultCompression, WithDecompress()))
+	router.POST("/", func(ctx context.Context, c *app.RequestContext) {
+		c.String(200, string(c.Request.Body()))
+	})
+
+	for _, header := range []string{"br", "gzip", "deflate", "zstd", "gzip, br", "zstd,deflate", "identity, gzip"} {
+		body := []byte(testResponse)
+		for _, coding := range contentCodings(header) {
+			body = encode(coding, body)
+		}
+		w := ut.PerformRequest(router, consts.MethodPost, "/", &ut.Body{Body: bytes.NewReader(body), Len: len(body)}, ut.Header{
+			Key: "Content-Encoding", Value: header,
+		}).Result()
+		assert.Equal(t, http.StatusOK, w.StatusCode(), header)
+		assert.Equal(t, testResponse, string(w.Body()), header)
+	}
+
+	w := ut.PerformRequest(router, consts.MethodPost, "/", &ut.Body{Body: strings.NewReader(testResponse), Len: len(testResponse)},
+		ut.Header{Key: "Content-Encoding", Value: "gzip, compress"},
+		ut.Header{Key: "Accept-Encoding", Value: "br"},
+	).Result()
+	assert.Equal(t, http.StatusUnsupportedMediaType, w.StatusCode())
+	assert.Equal(t, "br, gzip, deflate, zstd", w.Header.Get("Accept-Encoding"))
+	// the error response is not compressed
+	assert.Equal(t, "", w.Header.Get("Content-Encoding"))
+	for name, mw := range map[string]app.HandlerFunc{
+		"stream": BrotliStream(DefaultCompression, WithDecompress()),
+		"auto":   BrotliAuto(DefaultCompression, WithDecompress()),
+	} {
+		router := route.NewEngine(config.NewOptions([]config.Option{}))
+		router.Use(mw)
+		router.POST("/", func(ctx context.Context, c *app.RequestContext) {})
+		w := ut.PerformRequest(router, consts.MethodPost, "/", nil,
+			ut.Header{Key: "Content-Encoding", Value: "compress"},
+			ut.Header{Key: "Accept-Encoding", Value: "br"},
+		).Result()
+		assert.Equal(t, http.StatusUnsupportedMediaType, w.StatusCode(), name)
+		assert.Equal(t, "", w.Header.Get("Content-Encoding"), name)
+	}
+
+	// an empty body doesn't skip the check
+	w = ut.PerformRequest(router, consts.MethodPost, "/", nil, ut.Header{
+		Key: "Content-Encoding", Value: "compress",
+	}).Result()
+	assert.Equal(t, http.StatusUnsupportedMediaType, w.StatusCode())
+	assert.Equal(t, "br, gzip, deflate, zstd", w.Header.Get("Accept-Encoding"))
+	w = ut.PerformRequest(router, consts.MethodPost, "/", nil, ut.Header{
+		Key: "Content-Encoding", Value: "gzip",
+	}).Result()
+	assert.Equal(t, http.StatusOK, w.StatusCode())
+}
+
+func TestDecompressFnCodings(t *testing.T) {
+	var codings []string
+	custom := func(ctx context.Context, c *app.RequestContext) {
+		codings = append(codings, c.Request.Header.Get("Content-Encoding"))
+	}
+	perform := func(fn app.HandlerFunc, coding string) {
+		router := route.NewEngine(config.NewOptions([]config.Option{}))
+		router.Use(Brotli(DefaultCompression, WithDecompressFn(fn)))
+		router.POST("/", func(ctx context.Context, c *app.RequestContext) {})
+		ut.PerformRequest(router, consts.MethodPost, "/", nil, ut.Header{
+			Key: "Content-Encoding", Value: coding,
+		})
+	}
+
+	// a custom fn only gets br
+	for _, coding := range []string{"br", "gzip", "gzip, br", "zstd"} {
+		perform(custom, coding)
+	}
+	assert.Equal(t, []string{"br"}, codings)
+
+	// even wrapped, DefaultDecompressHandle is a custom fn
+	codings = nil
+	perform(func(ctx context.Context, c *app.RequestContext) {
+		custom(ctx, c)
+		DefaultDecompressHandle(ctx, c)
+	}, "gzip")
+	assert.Nil(t, codings)
+
+	_, err := NewBrotli(DefaultCompression, WithDecompress(WithMaxBodySize(-1)))
+	assert.NotNil(t, err)
+}
+
+func TestBrotliCacheKey(t *testing.T) {
+	cache := NewResponseCache(1<<20, time.Minute)
+	router := route.NewEngine(config.NewOptions([]config.Option{}))
+	router.Use(Brotli(DefaultCompression, WithCache(cache)))
+	router.GET("/etag", func(ctx context.Context, c *app.RequestContext) {
+		// a deploy version shared by every response
+		c.Header("ETag", `"v1"`)
+		c.String(200, c.Query("q")+string(c.Request.Host()))
+	})
+	router.GET("/weak", func(ctx context.Context, c *app.RequestContext) {
+		c.Header("ETag", `W/"v1"`)
+		c.String(200, c.Query("q"))
+	})
+
+	for _, tc := range []struct{ uri, host, want string }{
+		{"/etag?q=a", "a.example", "aa.example"},
+		{"/etag?q=b", "a.example", "ba.example"},
+		{"/etag?q=a", "b.example", "ab.example"},
+		{"/weak?q=a", "a.example", "a"},
+		{"/weak?q=b", "a.example", "b"},
+	} {
+		w := ut.PerformRequest(router, consts.MethodGet, "http://"+tc.host+tc.uri, nil, ut.Header{
+			Key: "Accept-Encoding", Value: "br",
+		}).Result()
+		data, err := io.ReadAll(brotli.NewReader(bytes.NewReader(w.Body())))
+		assert.Nil(t, err)
+		assert.Equal(t, tc.want, string(data), tc.uri)
+	}
+}
+
+func TestCompressDeadline(t *testing.T) {
+	body := make([]byte, 1<<20)
+	r := mrand.New(mrand.NewSource(1))
+	for i := range body {
+		body[i] = byte('a' + r.Intn(8))
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	_, err := compress(ctx, body, brotli.WriterOptions{Quality: BestCompression})
+	assert.Equal(t, context.DeadlineExceeded, err)
+	// level 11 takes seconds for this body, the overrun is a single slice
+	assert.Less(t, time.Since(start), 250*time.Millisecond)
+}
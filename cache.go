@@ -0,0 +1,107 @@
+package brotli_hz
+
+import (
+	"container/list"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// ResponseCache is an LRU cache of brotli encoded response bodies, bounded by
+// the total size of the cached bodies in bytes.
+type ResponseCache struct {
+	mu       sync.Mutex
+	maxBytes int64
+	ttl      time.Duration
+	size     int64
+	ll       *list.List
+	items    map[string]*list.Element
+
+	hits   atomic.Uint64
+	misses atomic.Uint64
+}
+
+type CacheStats struct {
+	Hits    uint64
+	Misses  uint64
+	Entries int
+	Bytes   int64
+}
+
+type cacheEntry struct {
+	key     string
+	data    []byte
+	expires time.Time
+}
+
+// NewResponseCache creates a cache holding at most maxBytes of encoded bodies,
+// ttl <= 0 means entries never expire.
+func NewResponseCache(maxBytes int64, ttl time.Duration) *ResponseCache {
+	return &ResponseCache{
+		maxBytes: maxBytes,
+		ttl:      ttl,
+		ll:       list.New(),
+		items:    make(map[string]*list.Element),
+	}
+}
+
+func (rc *ResponseCache) Get(key string) ([]byte, bool) {
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+
+	el, ok := rc.items[key]
+	if !ok {
+		rc.misses.Add(1)
+		return nil, false
+	}
+	entry := el.Value.(*cacheEntry)
+	if !entry.expires.IsZero() && time.Now().After(entry.expires) {
+		rc.removeElement(el)
+		rc.misses.Add(1)
+		return nil, false
+	}
+	rc.ll.MoveToFront(el)
+	rc.hits.Add(1)
+	return entry.data, true
+}
+
+func (rc *ResponseCache) Set(key string, data []byte) {
+	size := int64(len(data))
+	if size > rc.maxBytes {
+		return
+	}
+
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+
+	if el, ok := rc.items[key]; ok {
+		rc.removeElement(el)
+	}
+	entry := &cacheEntry{key: key, data: data}
+	if rc.ttl > 0 {
+		entry.expires = time.Now().Add(rc.ttl)
+	}
+	rc.items[key] = rc.ll.PushFront(entry)
+	rc.size += size
+
+	for rc.size > rc.maxBytes {
+		rc.removeElement(rc.ll.Back())
+	}
+}
+
+func (rc *ResponseCache) Stats() CacheStats {
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+	return CacheStats{
+		Hits:    rc.hits.Load(),
+		Misses:  rc.misses.Load(),
+		Entries: rc.ll.Len(),
+		Bytes:   rc.size,
+	}
+}
+
+func (rc *ResponseCache) removeElement(el *list.Element) {
+	entry := rc.ll.Remove(el).(*cacheEntry)
+	delete(rc.items, entry.key)
+	rc.size -= int64(len(entry.data))
+}
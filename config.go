@@ -0,0 +1,255 @@
+package brotli_hz
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/andybalholm/brotli"
+	"gopkg.in/yaml.v3"
+	"path"
+	"regexp"
+	"strings"
+)
+
+// Config describes the middleware declaratively, it maps onto Options with
+// Config.Options and onto ClientOptions with Config.ClientOptions. Unset
+// fields keep the defaults of the middleware.
+type Config struct {
+	Preset               string   `json:"preset,omitempty" yaml:"preset,omitempty"`
+	Level                *int     `json:"level,omitempty" yaml:"level,omitempty"`
+	LGWin                int      `json:"lgwin,omitempty" yaml:"lgwin,omitempty"`
+	ExcludedExtensions   []string `json:"excluded_extensions,omitempty" yaml:"excluded_extensions,omitempty"`
+	ExcludedPaths        []string `json:"excluded_paths,omitempty" yaml:"excluded_paths,omitempty"`
+	ExcludedPathRegexes  []string `json:"excluded_path_regexes,omitempty" yaml:"excluded_path_regexes,omitempty"`
+	ExcludedPathPatterns []string `json:"excluded_path_patterns,omitempty" yaml:"excluded_path_patterns,omitempty"`
+	IncludedExtensions   []string `json:"included_extensions,omitempty" yaml:"included_extensions,omitempty"`
+	IncludedPaths        []string `json:"included_paths,omitempty" yaml:"included_paths,omitempty"`
+	IncludedPathRegexes  []string `json:"included_path_regexes,omitempty" yaml:"included_path_regexes,omitempty"`
+	IncludedContentTypes []string `json:"included_content_types,omitempty" yaml:"included_content_types,omitempty"`
+	ExcludedContentTypes []string `json:"excluded_content_types,omitempty" yaml:"excluded_content_types,omitempty"`
+	MinLength            int      `json:"min_length,omitempty" yaml:"min_length,omitempty"`
+	Decompress           bool     `json:"decompress,omitempty" yaml:"decompress,omitempty"`
+	MaxDecompressWindow  int      `json:"max_decompress_window,omitempty" yaml:"max_decompress_window,omitempty"`
+}
+
+var presets = map[string]Preset{
+	"realtime": PresetRealtime,
+	"balanced": PresetBalanced,
+	"static":   PresetStatic,
+}
+
+// ParseJSONConfig decodes and validates a JSON config, unknown fields are rejected.
+func ParseJSONConfig(data []byte) (*Config, error) {
+	var cfg Config
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&cfg); err != nil {
+		return nil, fmt.Errorf("brotli_hz: decode config: %w", err)
+	}
+	if err := cfg.Validate(); err != nil {
+		return nil, err
+	}
+	return &cfg, nil
+}
+
+// ParseYAMLConfig decodes and validates a YAML config, unknown fields are rejected.
+func ParseYAMLConfig(data []byte) (*Config, error) {
+	var cfg Config
+	dec := yaml.NewDecoder(bytes.NewReader(data))
+	dec.KnownFields(true)
+	if err := dec.Decode(&cfg); err != nil {
+		return nil, fmt.Errorf("brotli_hz: decode config: %w", err)
+	}
+	if err := cfg.Validate(); err != nil {
+		return nil, err
+	}
+	return &cfg, nil
+}
+
+// Validate reports every invalid field of the config.
+func (cfg *Config) Validate() error {
+	var errs []error
+
+	wo := cfg.writerOptions()
+	if wo != nil {
+		if err := validateWriterOptions(*wo); err != nil {
+			errs = append(errs, err)
+		}
+	} else if cfg.LGWin != 0 {
+		errs = append(errs, errors.New("brotli_hz: lgwin requires level or preset"))
+	}
+	if cfg.Preset != "" {
+		if _, ok := presets[cfg.Preset]; !ok {
+			errs = append(errs, fmt.Errorf("brotli_hz: unknown preset %q", cfg.Preset))
+		}
+	}
+	kinds := [...]string{"excluded", "included"}
+	for i, exts := range [][]string{cfg.ExcludedExtensions, cfg.IncludedExtensions} {
+		for _, ext := range exts {
+			if !strings.HasPrefix(ext, ".") {
+				errs = append(errs, fmt.Errorf("brotli_hz: %s extension %q must start with a dot", kinds[i], ext))
+			}
+		}
+	}
+	for i, paths := range [][]string{cfg.ExcludedPaths, cfg.IncludedPaths} {
+		for _, path := range paths {
+			if !strings.HasPrefix(path, "/") {
+				errs = append(errs, fmt.Errorf("brotli_hz: %s path %q must start with a slash", kinds[i], path))
+			}
+		}
+	}
+	for i, regexes := range [][]string{cfg.ExcludedPathRegexes, cfg.IncludedPathRegexes} {
+		for _, r := range regexes {
+			if _, err := regexp.Compile(r); err != nil {
+				errs = append(errs, fmt.Errorf("brotli_hz: %s path regex %q: %w", kinds[i], r, err))
+			}
+		}
+	}
+	for _, p := range cfg.ExcludedPathPatterns {
+		for _, seg := range splitPath(p) {
+			if _, err := path.Match(seg, ""); err != nil {
+				errs = append(errs, fmt.Errorf("brotli_hz: excluded path pattern %q: %w", p, err))
+				break
+			}
+		}
+	}
+	for _, types := range [][]string{cfg.IncludedContentTypes, cfg.ExcludedContentTypes} {
+		for _, t := range types {
+			if strings.TrimSpace(t) == "" {
+				errs = append(errs, errors.New("brotli_hz: empty content type"))
+			}
+		}
+	}
+	if cfg.MinLength < 0 {
+		errs = append(errs, fmt.Errorf("brotli_hz: invalid min length %d", cfg.MinLength))
+	}
+	if cfg.MaxDecompressWindow != 0 && (cfg.MaxDecompressWindow < 10 || cfg.MaxDecompressWindow > 24) {
+		errs = append(errs, fmt.Errorf("brotli_hz: invalid max decompress window %d, must be between 10 and 24", cfg.MaxDecompressWindow))
+	}
+
+	return errors.Join(errs...)
+}
+
+// Options validates the config and converts it to server middleware options.
+func (cfg *Config) Options() ([]Option, error) {
+	if err := cfg.Validate(); err != nil {
+		return nil, err
+	}
+
+	var opts []Option
+	if p, ok := presets[cfg.Preset]; ok {
+		opts = append(opts, WithPreset(p))
+	}
+	if wo := cfg.writerOptions(); wo != nil {
+		opts = append(opts, WithWriterOptions(*wo))
+	}
+	if cfg.ExcludedExtensions != nil {
+		opts = append(opts, WithExcludedExtensions(cfg.ExcludedExtensions))
+	}
+	if cfg.ExcludedPaths != nil {
+		opts = append(opts, WithExcludedPaths(cfg.ExcludedPaths))
+	}
+	if cfg.ExcludedPathRegexes != nil {
+		opts = append(opts, WithExcludedPathRegexes(cfg.ExcludedPathRegexes))
+	}
+	if cfg.ExcludedPathPatterns != nil {
+		opts = append(opts, WithExcludedPathPatterns(cfg.ExcludedPathPatterns))
+	}
+	if cfg.IncludedExtensions != nil {
+		opts = append(opts, WithIncludedExtensions(cfg.IncludedExtensions))
+	}
+	if cfg.IncludedPaths != nil {
+		opts = append(opts, WithIncludedPaths(cfg.IncludedPaths))
+	}
+	if cfg.IncludedPathRegexes != nil {
+		opts = append(opts, WithIncludedPathRegexes(cfg.IncludedPathRegexes))
+	}
+	if cfg.IncludedContentTypes != nil {
+		opts = append(opts, WithIncludedContentTypes(cfg.IncludedContentTypes))
+	}
+	if cfg.ExcludedContentTypes != nil {
+		opts = append(opts, WithExcludedContentTypes(cfg.ExcludedContentTypes))
+	}
+	if cfg.MinLength > 0 {
+		opts = append(opts, WithMinLength(cfg.MinLength))
+	}
+	if cfg.Decompress {
+		opts = append(opts, WithDecompress())
+	}
+	if cfg.MaxDecompressWindow > 0 {
+		opts = append(opts, WithMaxDecompressWindow(cfg.MaxDecompressWindow))
+	}
+	return opts, nil
+}
+
+// ClientOptions validates the config and converts it to client middleware options.
+func (cfg *Config) ClientOptions() ([]ClientOption, error) {
+	if err := cfg.Validate(); err != nil {
+		return nil, err
+	}
+
+	var opts []ClientOption
+	if p, ok := presets[cfg.Preset]; ok {
+		opts = append(opts, WithClientPreset(p))
+	}
+	if wo := cfg.writerOptions(); wo != nil {
+		opts = append(opts, WithClientWriterOptions(*wo))
+	}
+	if cfg.ExcludedExtensions != nil {
+		opts = append(opts, WithClientExcludedExtensions(cfg.ExcludedExtensions))
+	}
+	if cfg.ExcludedPaths != nil {
+		opts = append(opts, WithClientExcludedPaths(cfg.ExcludedPaths))
+	}
+	if cfg.ExcludedPathRegexes != nil {
+		opts = append(opts, WithClientExcludedPathRegexes(cfg.ExcludedPathRegexes))
+	}
+	if cfg.ExcludedPathPatterns != nil {
+		opts = append(opts, WithClientExcludedPathPatterns(cfg.ExcludedPathPatterns))
+	}
+	if cfg.IncludedExtensions != nil {
+		opts = append(opts, WithClientIncludedExtensions(cfg.IncludedExtensions))
+	}
+	if cfg.IncludedPaths != nil {
+		opts = append(opts, WithClientIncludedPaths(cfg.IncludedPaths))
+	}
+	if cfg.IncludedPathRegexes != nil {
+		opts = append(opts, WithClientIncludedPathRegexes(cfg.IncludedPathRegexes))
+	}
+	if cfg.IncludedContentTypes != nil {
+		opts = append(opts, WithClientIncludedContentTypes(cfg.IncludedContentTypes))
+	}
+	if cfg.ExcludedContentTypes != nil {
+		opts = append(opts, WithClientExcludedContentTypes(cfg.ExcludedContentTypes))
+	}
+	if cfg.MinLength > 0 {
+		opts = append(opts, WithClientMinLength(cfg.MinLength))
+	}
+	if cfg.Decompress {
+		opts = append(opts, WithClientDecompressFn(DefaultClientDecompressHandle))
+	}
+	if cfg.MaxDecompressWindow > 0 {
+		opts = append(opts, WithClientMaxDecompressWindow(cfg.MaxDecompressWindow))
+	}
+	return opts, nil
+}
+
+// writerOptions returns nil if the config sets neither a level nor a preset,
+// an explicit level overrides the level of the preset.
+func (cfg *Config) writerOptions() *brotli.WriterOptions {
+	var wo *brotli.WriterOptions
+	if p, ok := presets[cfg.Preset]; ok {
+		wo = &brotli.WriterOptions{Quality: p.Level, LGWin: p.LGWin}
+	}
+	if cfg.Level != nil {
+		if wo == nil {
+			wo = &brotli.WriterOptions{}
+		}
+		wo.Quality = *cfg.Level
+	}
+	if wo != nil && cfg.LGWin != 0 {
+		wo.LGWin = cfg.LGWin
+	}
+	return wo
+}
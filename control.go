@@ -0,0 +1,126 @@
+package brotli_hz
+
+import (
+	"bytes"
+	"github.com/andybalholm/brotli"
+	"github.com/cloudwego/hertz/pkg/app"
+	"io"
+)
+
+const (
+	// controlKey stores the decision of the handler in the RequestContext.
+	controlKey = "brotli_hz.control"
+	// preEncodedKey marks a body set by SetBrotliBody.
+	preEncodedKey = "brotli_hz.pre_encoded"
+)
+
+// control is what a handler decided for its response, the middleware reads it
+// after c.Next for buffered responses and at the first write for streamed ones.
+type control struct {
+	disable bool
+	force   bool
+	level   *int
+}
+
+// DisableCompression sends the response of c uncompressed.
+func DisableCompression(c *app.RequestContext) {
+	ctl := getControl(c)
+	ctl.disable, ctl.force = true, false
+	c.Set(controlKey, ctl)
+}
+
+// ForceCompression compresses the response of c even if its size, content type
+// or status code would not be. Requests the middleware skips entirely, e.g.
+// without br in Accept-Encoding or on an excluded path, stay uncompressed.
+func ForceCompression(c *app.RequestContext) {
+	ctl := getControl(c)
+	ctl.disable, ctl.force = false, true
+	c.Set(controlKey, ctl)
+}
+
+// SetCompressionLevel compresses the response of c with level instead of the
+// level of the middleware.
+func SetCompressionLevel(c *app.RequestContext, level int) error {
+	if err := ValidateLevel(level); err != nil {
+		return err
+	}
+	ctl := getControl(c)
+	ctl.level = &level
+	c.Set(controlKey, ctl)
+	return nil
+}
+
+func getControl(c *app.RequestContext) control {
+	if v, ok := c.Get(controlKey); ok {
+		if ctl, ok := v.(control); ok {
+			return ctl
+		}
+	}
+	return control{}
+}
+
+// writerOptions applies the level of the handler to the options of the
+// middleware, before the limiter reserves their budget or degrades them.
+func (ctl control) writerOptions(wo brotli.WriterOptions) brotli.WriterOptions {
+	if ctl.level != nil {
+		wo.Quality = *ctl.level
+	}
+	return wo
+}
+
+// decide applies the decision of the handler on top of that of the middleware.
+func (ctl control) decide(compress bool) bool {
+	return !ctl.disable && (ctl.force || compress)
+}
+
+// SetBrotliBody responds with data which is already brotli encoded. The
+// middleware sends it as is to clients accepting br and decodes it while
+// sending for the others.
+func SetBrotliBody(c *app.RequestContext, data []byte) {
+	SetBrotliBodyStream(c, bytes.NewReader(data), len(data))
+}
+
+// SetBrotliBodyStream is SetBrotliBody for an encoded stream of size bytes, -1
+// if unknown.
+func SetBrotliBodyStream(c *app.RequestContext, r io.Reader, size int) {
+	c.Set(preEncodedKey, true)
+	c.Response.Header.Set("Content-Encoding", "br")
+	c.Response.Header.Set("Vary", "Accept-Encoding")
+	// not SetBody, a streaming middleware would encode it again
+	c.Response.SetBodyStream(r, size)
+}
+
+func preEncoded(c *app.RequestContext) bool {
+	return c.GetBool(preEncodedKey)
+}
+
+// servePreEncoded decodes a body set with SetBrotliBody if the client does not
+// accept br, it reports whether the response was pre-encoded.
+func servePreEncoded(c *app.RequestContext) bool {
+	if !preEncoded(c) {
+		return false
+	}
+	if acceptsBrotli(&c.Request) {
+		return true
+	}
+	c.Response.Header.Del("Content-Encoding")
+	src := c.Response.BodyStream()
+	c.Response.SetBodyStreamNoReset(&brotliDecodeReader{
+		Reader: brotli.NewReader(src),
+		src:    src,
+	}, -1)
+	return true
+}
+
+// brotliDecodeReader closes the encoded stream once hertz wrote the body.
+type brotliDecodeReader struct {
+	io.Reader
+	src io.Reader
+}
+
+func (r *brotliDecodeReader) Close() error {
+	if c, ok := r.src.(io.Closer); ok {
+		return c.Close()
+	}
+	return nil
+}
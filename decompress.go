@@ -0,0 +1,234 @@
+package brotli_hz
+
+import (
+	"bytes"
+	"compress/gzip"
+	"compress/zlib"
+	"context"
+	"errors"
+	"fmt"
+	"github.com/andybalholm/brotli"
+	"github.com/cloudwego/hertz/pkg/app"
+	"github.com/cloudwego/hertz/pkg/protocol/consts"
+	"github.com/klauspost/compress/zstd"
+	"io"
+	"strings"
+)
+
+var (
+	// ErrBodyTooLarge is reported when a decompressed request body exceeds
+	// DecompressOptions.MaxBodySize.
+	ErrBodyTooLarge = errors.New("brotli_hz: decompressed request body too large")
+	// ErrUnsupportedEncoding is reported for a Content-Encoding without decoder.
+	ErrUnsupportedEncoding = errors.New("brotli_hz: unsupported content encoding")
+)
+
+// defaultZstdWindow bounds the zstd window if MaxDecompressWindow is not set,
+// the decoder would otherwise allocate whatever window a frame declares.
+const defaultZstdWindow = 8 << 20
+
+// decoders holds the content codings the decompression middleware accepts,
+// deflate being the zlib format as specified by RFC 9110.
+var decoders = map[string]func(io.Reader, *DecompressOptions) (io.ReadCloser, error){
+	"br": func(r io.Reader, _ *DecompressOptions) (io.ReadCloser, error) {
+		return io.NopCloser(brotli.NewReader(r)), nil
+	},
+	"gzip": func(r io.Reader, _ *DecompressOptions) (io.ReadCloser, error) {
+		return gzip.NewReader(r)
+	},
+	"x-gzip": func(r io.Reader, _ *DecompressOptions) (io.ReadCloser, error) {
+		return gzip.NewReader(r)
+	},
+	"deflate": func(r io.Reader, _ *DecompressOptions) (io.ReadCloser, error) {
+		return zlib.NewReader(r)
+	},
+	"zstd": func(r io.Reader, options *DecompressOptions) (io.ReadCloser, error) {
+		window := uint64(defaultZstdWindow)
+		if lgwin := options.MaxDecompressWindow; lgwin > 0 {
+			window = 1 << lgwin
+		}
+		dopts := []zstd.DOption{zstd.WithDecoderConcurrency(1), zstd.WithDecoderMaxWindow(window)}
+		if options.MaxBodySize > 0 {
+			dopts = append(dopts, zstd.WithDecoderMaxMemory(uint64(options.MaxBodySize)))
+		}
+		d, err := zstd.NewReader(r, dopts...)
+		if err != nil {
+			return nil, err
+		}
+		return d.IOReadCloser(), nil
+	},
+}
+
+// acceptedEncodings is sent in the Accept-Encoding response header when a
+// request uses another coding (RFC 7694).
+const acceptedEncodings = "br, gzip, deflate, zstd"
+
+// request decompression middleware options
+type (
+	DecompressOption  func(*DecompressOptions)
+	DecompressOptions struct {
+		// MaxBodySize limits the decompressed body, 0 disables the limit.
+		MaxBodySize         int
+		MaxDecompressWindow int
+		// Paths limits decompression to these path prefixes, all if empty.
+		Paths        IncludedPaths
+		ErrorHandler func(ctx context.Context, c *app.RequestContext, err error)
+	}
+)
+
+func newDecompressOptions(opts ...DecompressOption) *DecompressOptions {
+	options := &DecompressOptions{
+		ErrorHandler: DefaultDecompressErrorHandler,
+	}
+	for _, opt := range opts {
+		opt(options)
+	}
+	return options
+}
+
+func WithMaxBodySize(n int) DecompressOption {
+	return func(o *DecompressOptions) {
+		o.MaxBodySize = n
+	}
+}
+
+// WithDecompressWindow rejects br and zstd request bodies encoded with a
+// window larger than 2^lgwin, see WithMaxDecompressWindow. zstd windows are
+// limited to 8MB if it is not set.
+func WithDecompressWindow(lgwin int) DecompressOption {
+	return func(o *DecompressOptions) {
+		o.MaxDecompressWindow = lgwin
+	}
+}
+
+func WithDecompressPaths(paths []string) DecompressOption {
+	return func(o *DecompressOptions) {
+		o.Paths = NewIncludedPaths(paths)
+	}
+}
+
+func WithDecompressErrorHandler(fn func(ctx context.Context, c *app.RequestContext, err error)) DecompressOption {
+	return func(o *DecompressOptions) {
+		o.ErrorHandler = fn
+	}
+}
+
+// DefaultDecompressErrorHandler aborts with 413 for ErrBodyTooLarge, 415 for
+// ErrUnsupportedEncoding and 400 for bodies which fail to decode.
+func DefaultDecompressErrorHandler(_ context.Context, c *app.RequestContext, err error) {
+	switch {
+	case errors.Is(err, ErrBodyTooLarge):
+		_ = c.AbortWithError(consts.StatusRequestEntityTooLarge, err)
+	case errors.Is(err, ErrUnsupportedEncoding):
+		_ = c.AbortWithError(consts.StatusUnsupportedMediaType, err)
+	default:
+		_ = c.AbortWithError(consts.StatusBadRequest, err)
+	}
+}
+
+// Decompress panics if the configuration is invalid, use NewDecompress to
+// handle the error.
+func Decompress(opts ...DecompressOption) app.HandlerFunc {
+	return must(NewDecompress(opts...))
+}
+
+// NewDecompress decodes br, gzip, deflate and zstd request bodies, including
+// stacked codings such as "gzip, br", and leaves responses alone, so it works
+// with any response compressor. WithDecompress runs it within Brotli.
+func NewDecompress(opts ...DecompressOption) (app.HandlerFunc, error) {
+	options := newDecompressOptions(opts...)
+	if options.MaxBodySize < 0 {
+		return nil, fmt.Errorf("brotli_hz: invalid max body size %d", options.MaxBodySize)
+	}
+	if w := options.MaxDecompressWindow; w != 0 && (w < 10 || w > 24) {
+		return nil, fmt.Errorf("brotli_hz: invalid max decompress window %d, must be between 10 and 24", w)
+	}
+	return func(ctx context.Context, c *app.RequestContext) {
+		codings := contentCodings(c.Request.Header.Get("Content-Encoding"))
+		if len(codings) == 0 {
+			return
+		}
+		if len(options.Paths) > 0 && !options.Paths.Contains(string(c.Request.URI().Path())) {
+			return
+		}
+		body := c.Request.Body()
+		// an unsupported coding gets 415 and the accepted codings, even
+		// with an empty body
+		err := unsupportedCoding(codings)
+		if err == nil && len(body) <= 0 {
+			return
+		}
+		var data []byte
+		if err == nil {
+			data, err = decompressBody(body, codings, options)
+		}
+		if err != nil {
+			if errors.Is(err, ErrUnsupportedEncoding) {
+				c.Response.Header.Set("Accept-Encoding", acceptedEncodings)
+			}
+			options.ErrorHandler(ctx, c, err)
+			return
+		}
+		c.Request.Header.DelBytes([]byte("Content-Encoding"))
+		c.Request.Header.DelBytes([]byte("Content-Length"))
+		c.Request.SetBody(data)
+	}, nil
+}
+
+// contentCodings lists the codings of a Content-Encoding header in the order
+// they were applied, without identity.
+func contentCodings(header string) []string {
+	var codings []string
+	for _, coding := range strings.Split(header, ",") {
+		coding = strings.ToLower(strings.TrimSpace(coding))
+		if coding != "" && coding != "identity" {
+			codings = append(codings, coding)
+		}
+	}
+	return codings
+}
+
+func unsupportedCoding(codings []string) error {
+	for _, coding := range codings {
+		if _, ok := decoders[coding]; !ok {
+			return fmt.Errorf("%w %q", ErrUnsupportedEncoding, coding)
+		}
+	}
+	return nil
+}
+
+// decompressBody expects codings checked with unsupportedCoding.
+func decompressBody(body []byte, codings []string, options *DecompressOptions) ([]byte, error) {
+	// only the outermost coding can be inspected before decoding
+	if codings[len(codings)-1] == "br" {
+		if err := checkWindow(body, options.MaxDecompressWindow); err != nil {
+			return nil, err
+		}
+	}
+
+	// undo the codings in the reverse order of their application
+	var r io.Reader = bytes.NewReader(body)
+	for i := len(codings) - 1; i >= 0; i-- {
+		rc, err := decoders[codings[i]](r, options)
+		if err != nil {
+			return nil, err
+		}
+		defer rc.Close() // nolint:errcheck
+		r = rc
+	}
+	if options.MaxBodySize > 0 {
+		// one more byte tells a body of exactly MaxBodySize from a larger one
+		r = io.LimitReader(r, int64(options.MaxBodySize)+1)
+	}
+	data, err := io.ReadAll(r)
+	if errors.Is(err, zstd.ErrDecoderSizeExceeded) {
+		return nil, ErrBodyTooLarge
+	}
+	if err != nil {
+		return nil, err
+	}
+	if options.MaxBodySize > 0 && len(data) > options.MaxBodySize {
+		return nil, ErrBodyTooLarge
+	}
+	return data, nil
+}
@@ -0,0 +1,104 @@
+package brotli_hz
+
+import (
+	"bytes"
+	"github.com/cloudwego/hertz/pkg/network"
+	"sync"
+	"time"
+)
+
+// FlushPolicy flushes a streamed response once any of its thresholds is
+// reached, zero values disable the corresponding threshold.
+type FlushPolicy struct {
+	// Bytes flushes after this many uncompressed bytes were written.
+	Bytes int
+	// Idle flushes pending data when nothing was written for this long.
+	Idle time.Duration
+	// Newline flushes after every write containing a newline, e.g. NDJSON records.
+	Newline bool
+}
+
+// autoFlushWriter applies a FlushPolicy on top of a streaming writer, the idle
+// flush runs on a timer goroutine so calls are serialized by mu.
+type autoFlushWriter struct {
+	mu      sync.Mutex
+	w       network.ExtWriter
+	policy  FlushPolicy
+	pending int
+	timer   *time.Timer
+	closed  bool
+	err     error
+}
+
+func newAutoFlushWriter(w network.ExtWriter, policy FlushPolicy) *autoFlushWriter {
+	return &autoFlushWriter{
+		w:      w,
+		policy: policy,
+	}
+}
+
+func (aw *autoFlushWriter) Write(p []byte) (n int, err error) {
+	aw.mu.Lock()
+	defer aw.mu.Unlock()
+
+	// report a failed idle flush to the handler
+	if aw.err != nil {
+		return 0, aw.err
+	}
+	if n, err = aw.w.Write(p); err != nil {
+		return
+	}
+	aw.pending += len(p)
+
+	if (aw.policy.Bytes > 0 && aw.pending >= aw.policy.Bytes) ||
+		(aw.policy.Newline && bytes.IndexByte(p, '\n') >= 0) {
+		return n, aw.flush()
+	}
+	if aw.policy.Idle > 0 {
+		if aw.timer == nil {
+			aw.timer = time.AfterFunc(aw.policy.Idle, aw.idleFlush)
+		} else {
+			aw.timer.Reset(aw.policy.Idle)
+		}
+	}
+	return
+}
+
+func (aw *autoFlushWriter) Flush() error {
+	aw.mu.Lock()
+	defer aw.mu.Unlock()
+
+	if aw.err != nil {
+		return aw.err
+	}
+	return aw.flush()
+}
+
+func (aw *autoFlushWriter) Finalize() error {
+	aw.mu.Lock()
+	defer aw.mu.Unlock()
+
+	aw.closed = true
+	if aw.timer != nil {
+		aw.timer.Stop()
+	}
+	return aw.w.Finalize()
+}
+
+func (aw *autoFlushWriter) idleFlush() {
+	aw.mu.Lock()
+	defer aw.mu.Unlock()
+
+	if aw.closed || aw.pending == 0 || aw.err != nil {
+		return
+	}
+	aw.err = aw.flush()
+}
+
+func (aw *autoFlushWriter) flush() error {
+	aw.pending = 0
+	if aw.timer != nil {
+		aw.timer.Stop()
+	}
+	return aw.w.Flush()
+}
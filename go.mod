@@ -5,7 +5,9 @@ go 1.23.4
 require (
 	github.com/andybalholm/brotli v1.1.1
 	github.com/cloudwego/hertz v0.9.4
+	github.com/klauspost/compress v1.17.11
 	github.com/stretchr/testify v1.8.1
+	gopkg.in/yaml.v3 v3.0.1
 )
 
 require (
@@ -28,5 +30,4 @@ require (
 	golang.org/x/arch v0.0.0-20210923205945-b76863e36670 // indirect
 	golang.org/x/sys v0.24.0 // indirect
 	google.golang.org/protobuf v1.27.1 // indirect
-	gopkg.in/yaml.v3 v3.0.1 // indirect
 )
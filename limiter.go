@@ -0,0 +1,193 @@
+package brotli_hz
+
+import (
+	"context"
+	"errors"
+	"github.com/andybalholm/brotli"
+	"github.com/cloudwego/hertz/pkg/app"
+	"sync"
+	"time"
+)
+
+var errBudgetExceeded = errors.New("brotli_hz: encoder exceeds the memory budget")
+
+// Limiter bounds the number of brotli encoders in flight and their estimated
+// memory, it is meant to be shared by all middlewares of a process.
+type Limiter struct {
+	mu          sync.Mutex
+	maxEncoders int
+	maxMemory   int64
+	encoders    int
+	memory      int64
+	// released is closed and replaced whenever budget is returned
+	released chan struct{}
+}
+
+// NewLimiter creates a Limiter, a value <= 0 leaves that dimension unbounded.
+func NewLimiter(maxEncoders int, maxMemory int64) *Limiter {
+	return &Limiter{
+		maxEncoders: maxEncoders,
+		maxMemory:   maxMemory,
+		released:    make(chan struct{}),
+	}
+}
+
+// TryAcquire reserves an encoder of the given estimated memory without waiting,
+// release must be called once the encoder is done.
+func (l *Limiter) TryAcquire(memory int64) (release func(), ok bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if !l.fits(memory) {
+		return nil, false
+	}
+	return l.reserve(memory), true
+}
+
+// Acquire is like TryAcquire but waits for budget until ctx is done.
+func (l *Limiter) Acquire(ctx context.Context, memory int64) (release func(), err error) {
+	if l.maxMemory > 0 && memory > l.maxMemory {
+		return nil, errBudgetExceeded
+	}
+	for {
+		l.mu.Lock()
+		if l.fits(memory) {
+			release = l.reserve(memory)
+			l.mu.Unlock()
+			return release, nil
+		}
+		released := l.released
+		l.mu.Unlock()
+
+		select {
+		case <-released:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+}
+
+// InUse reports the encoders in flight and their estimated memory.
+func (l *Limiter) InUse() (encoders int, memory int64) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.encoders, l.memory
+}
+
+func (l *Limiter) fits(memory int64) bool {
+	return (l.maxEncoders <= 0 || l.encoders < l.maxEncoders) &&
+		(l.maxMemory <= 0 || l.memory+memory <= l.maxMemory)
+}
+
+func (l *Limiter) reserve(memory int64) func() {
+	l.encoders++
+	l.memory += memory
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			l.mu.Lock()
+			l.encoders--
+			l.memory -= memory
+			close(l.released)
+			l.released = make(chan struct{})
+			l.mu.Unlock()
+		})
+	}
+}
+
+// EncoderMemory estimates the memory of a brotli encoder: its ring buffer,
+// which grows with the window, and its hash tables, which grow with the quality.
+func EncoderMemory(wo brotli.WriterOptions) int64 {
+	lgwin := wo.LGWin
+	if lgwin == 0 {
+		lgwin = 22
+	}
+	if wo.Quality <= 1 {
+		lgwin = 18
+	}
+	window := int64(1) << lgwin
+
+	var hasher int64
+	switch {
+	case wo.Quality <= 1:
+		hasher = 128 << 10
+	case wo.Quality <= 4:
+		hasher = 512 << 10
+	case wo.Quality <= 9:
+		hasher = 2 << 20
+	default:
+		// binary tree matcher, two uint32 per window position
+		hasher = 8 * window
+	}
+	return window + hasher
+}
+
+type LimitDecision int
+
+const (
+	// LimitAcquired means the encoder got the budget right away.
+	LimitAcquired LimitDecision = iota
+	// LimitWaited means the encoder got the budget after waiting.
+	LimitWaited
+	// LimitDegraded means the response is compressed with the degraded options.
+	LimitDegraded
+	// LimitIdentity means the response is sent uncompressed.
+	LimitIdentity
+)
+
+func (d LimitDecision) String() string {
+	switch d {
+	case LimitAcquired:
+		return "acquired"
+	case LimitWaited:
+		return "waited"
+	case LimitDegraded:
+		return "degraded"
+	case LimitIdentity:
+		return "identity"
+	}
+	return "unknown"
+}
+
+// LimitPolicy decides what happens when the Limiter has no budget left:
+// wait up to Wait, then compress with Degrade if it fits, else send identity.
+type LimitPolicy struct {
+	Wait       time.Duration
+	Degrade    *brotli.WriterOptions
+	OnDecision func(c *app.RequestContext, decision LimitDecision)
+}
+
+// acquireEncoder reserves the budget of an encoder with wo, the options of the
+// request. It returns the options to compress with, which may be degraded, and
+// the release func of the budget, ok is false if the response must not be
+// compressed.
+func (bs *brotliSrvMiddleware) acquireEncoder(ctx context.Context, c *app.RequestContext, wo brotli.WriterOptions) (_ brotli.WriterOptions, release func(), ok bool) {
+	l := bs.options.Limiter
+	if l == nil {
+		return wo, func() {}, true
+	}
+	policy := bs.options.LimitPolicy
+
+	decision := LimitAcquired
+	release, ok = l.TryAcquire(EncoderMemory(wo))
+	if !ok && policy.Wait > 0 {
+		decision = LimitWaited
+		wctx, cancel := context.WithTimeout(ctx, policy.Wait)
+		var err error
+		release, err = l.Acquire(wctx, EncoderMemory(wo))
+		cancel()
+		ok = err == nil
+	}
+	if !ok && policy.Degrade != nil {
+		decision = LimitDegraded
+		wo = *policy.Degrade
+		release, ok = l.TryAcquire(EncoderMemory(wo))
+	}
+	if !ok {
+		decision = LimitIdentity
+	}
+
+	if policy.OnDecision != nil {
+		policy.OnDecision(c, decision)
+	}
+	return wo, release, ok
+}
@@ -0,0 +1,180 @@
+package brotli_hz
+
+import (
+	"regexp"
+	"regexp/syntax"
+	"strings"
+)
+
+// pathPrefixes is ExcludedPaths compiled into a prefix tree once the options
+// are applied.
+type pathPrefixes struct {
+	tree *prefixNode
+	n    int
+}
+
+func compilePaths(paths ExcludedPaths) pathPrefixes {
+	res := pathPrefixes{tree: &prefixNode{}, n: len(paths)}
+	for _, p := range paths {
+		res.tree.insert(toLowerASCII(p)).terminal = true
+	}
+	return res
+}
+
+// Contains matches path prefixes, ASCII letters case-insensitively.
+func (pp pathPrefixes) Contains(uri string) bool {
+	return pp.tree.hasPrefixOf(uri, true)
+}
+
+// pathRegexes is ExcludedPathRegexes compiled once the options are applied:
+// regexes anchored with ^ only run for paths starting with their literal
+// prefix, the others are merged into a single regex, which still grows with
+// their number.
+type pathRegexes struct {
+	anchored   *prefixNode
+	unanchored *regexp.Regexp
+	n          int
+}
+
+func compileRegexes(regexes ExcludedPathRegexes) pathRegexes {
+	res := pathRegexes{anchored: &prefixNode{}, n: len(regexes)}
+	var unanchored []string
+	for _, re := range regexes {
+		if prefix, ok := anchoredPrefix(re.String()); ok {
+			n := res.anchored.insert(prefix)
+			n.regexes = append(n.regexes, re)
+		} else {
+			unanchored = append(unanchored, re.String())
+		}
+	}
+	res.unanchored = mergeRegexes(unanchored)
+	return res
+}
+
+func (pr pathRegexes) Contains(uri string) bool {
+	if pr.anchored.matchRegexes(uri) {
+		return true
+	}
+	return pr.unanchored != nil && pr.unanchored.MatchString(uri)
+}
+
+// prefixNode is a byte-wise prefix tree, looking a path up costs one step per
+// byte of the path.
+type prefixNode struct {
+	children map[byte]*prefixNode
+	terminal bool
+	// regexes holds the anchored regexes starting with the prefix of the node
+	regexes []*regexp.Regexp
+}
+
+func (n *prefixNode) insert(prefix string) *prefixNode {
+	for i := 0; i < len(prefix); i++ {
+		child := n.children[prefix[i]]
+		if child == nil {
+			if n.children == nil {
+				n.children = make(map[byte]*prefixNode)
+			}
+			child = &prefixNode{}
+			n.children[prefix[i]] = child
+		}
+		n = child
+	}
+	return n
+}
+
+// hasPrefixOf reports whether a stored prefix is a prefix of s, comparing
+// ASCII letters case-insensitively if fold is set.
+func (n *prefixNode) hasPrefixOf(s string, fold bool) bool {
+	for i := 0; n != nil; i++ {
+		if n.terminal {
+			return true
+		}
+		if i == len(s) {
+			return false
+		}
+		c := s[i]
+		if fold {
+			c = lowerASCII(c)
+		}
+		n = n.children[c]
+	}
+	return false
+}
+
+// matchRegexes runs the regexes stored along the path of s only.
+func (n *prefixNode) matchRegexes(s string) bool {
+	for i := 0; n != nil; i++ {
+		for _, r := range n.regexes {
+			if r.MatchString(s) {
+				return true
+			}
+		}
+		if i == len(s) {
+			return false
+		}
+		n = n.children[s[i]]
+	}
+	return false
+}
+
+// anchoredPrefix returns the literal every match of expr starts with if expr
+// is anchored at the start of the text, e.g. "/api/" for `^/api/v\d+`.
+func anchoredPrefix(expr string) (string, bool) {
+	re, err := syntax.Parse(expr, syntax.Perl)
+	if err != nil {
+		return "", false
+	}
+	re = re.Simplify()
+	if re.Op != syntax.OpConcat || len(re.Sub) == 0 || re.Sub[0].Op != syntax.OpBeginText {
+		return "", false
+	}
+	if len(re.Sub) > 1 {
+		if lit := re.Sub[1]; lit.Op == syntax.OpLiteral && lit.Flags&syntax.FoldCase == 0 {
+			return string(lit.Rune), true
+		}
+	}
+	return "", true
+}
+
+// mergeRegexes compiles regexes into a single automaton, so the path is
+// scanned once instead of once per regex.
+func mergeRegexes(exprs []string) *regexp.Regexp {
+	switch len(exprs) {
+	case 0:
+		return nil
+	case 1:
+		return regexp.MustCompile(exprs[0])
+	}
+	return regexp.MustCompile("(?:" + strings.Join(exprs, ")|(?:") + ")")
+}
+
+// lowerASCII folds ASCII letters only, the path prefixes don't apply Unicode
+// case rules.
+func lowerASCII(c byte) byte {
+	if 'A' <= c && c <= 'Z' {
+		c += 'a' - 'A'
+	}
+	return c
+}
+
+func toLowerASCII(s string) string {
+	b := []byte(s)
+	for i := range b {
+		b[i] = lowerASCII(b[i])
+	}
+	return string(b)
+}
+
+// hasPrefixFoldASCII reports whether s starts with prefix, ASCII letters
+// compared case-insensitively.
+func hasPrefixFoldASCII(s, prefix string) bool {
+	if len(s) < len(prefix) {
+		return false
+	}
+	for i := 0; i < len(prefix); i++ {
+		if lowerASCII(s[i]) != lowerASCII(prefix[i]) {
+			return false
+		}
+	}
+	return true
+}
@@ -1,37 +1,65 @@
 package brotli_hz
 
 import (
+	"fmt"
+	"path"
 	"regexp"
+	"strconv"
 	"strings"
+	"unicode"
 )
 
 type (
 	ExcludedPaths       []string
 	ExcludedPathRegexes []*regexp.Regexp
 	ExcludedExtensions  map[string]struct{}
+	PathPatterns        [][]string
+	Routes              map[string]struct{}
+	Methods             map[string]struct{}
+	StatusCodes         [][2]int
+	ContentTypes        []string
+
+	// the included rules share the matching of their excluded counterparts
+	IncludedPaths       = ExcludedPaths
+	IncludedPathRegexes = ExcludedPathRegexes
+	IncludedExtensions  = ExcludedExtensions
 )
 
 func NewExcludedPaths(paths []string) ExcludedPaths {
 	return ExcludedPaths(paths)
 }
 
+// Contains matches path prefixes, ASCII letters case-insensitively. The
+// middlewares match a prefix tree compiled from the paths instead, see
+// compilePaths.
 func (eps ExcludedPaths) Contains(uri string) bool {
 	for _, p := range eps {
-		if strings.HasPrefix(uri, p) {
+		if hasPrefixFoldASCII(uri, p) {
 			return true
 		}
 	}
 	return false
 }
 
+// NewExcludedPathRegexes panics on an invalid regex like regexp.MustCompile.
 func NewExcludedPathRegexes(regexes []string) ExcludedPathRegexes {
+	return must(parsePathRegexes(regexes))
+}
+
+func parsePathRegexes(regexes []string) (ExcludedPathRegexes, error) {
 	res := make(ExcludedPathRegexes, len(regexes))
 	for i, r := range regexes {
-		res[i] = regexp.MustCompile(r)
+		re, err := regexp.Compile(r)
+		if err != nil {
+			return nil, fmt.Errorf("brotli_hz: invalid path regex %q: %w", r, err)
+		}
+		res[i] = re
 	}
-	return res
+	return res, nil
 }
 
+// Contains runs the regexes one by one. The middlewares match them compiled
+// by compileRegexes instead.
 func (epr ExcludedPathRegexes) Contains(uri string) bool {
 	for _, r := range epr {
 		if r.MatchString(uri) {
@@ -44,12 +72,206 @@ func (epr ExcludedPathRegexes) Contains(uri string) bool {
 func NewExcludedExtensions(exts []string) ExcludedExtensions {
 	res := make(ExcludedExtensions)
 	for _, e := range exts {
-		res[e] = struct{}{}
+		res[strings.ToLower(e)] = struct{}{}
 	}
 	return res
 }
 
+// Contains matches extensions case-insensitively, so ".PNG" matches ".png".
 func (ees ExcludedExtensions) Contains(ext string) bool {
-	_, ok := ees[ext]
+	_, ok := ees[strings.ToLower(ext)]
 	return ok
 }
+
+func NewIncludedPaths(paths []string) IncludedPaths {
+	return NewExcludedPaths(paths)
+}
+
+func NewIncludedPathRegexes(regexes []string) IncludedPathRegexes {
+	return NewExcludedPathRegexes(regexes)
+}
+
+func NewIncludedExtensions(exts []string) IncludedExtensions {
+	return NewExcludedExtensions(exts)
+}
+
+// included applies the included rules after the excluded ones: a path must
+// match IncludedExtensions if set, and IncludedPaths or IncludedPathRegexes
+// if either is set.
+func included(path, ext string, paths pathPrefixes, regexes pathRegexes, exts IncludedExtensions) bool {
+	if len(exts) > 0 && !exts.Contains(ext) {
+		return false
+	}
+	if paths.n > 0 || regexes.n > 0 {
+		return paths.Contains(path) || regexes.Contains(path)
+	}
+	return true
+}
+
+// NewPathPatterns accepts hertz route patterns such as "/api/:id/*rest" and
+// globs such as "/static/*.js", it panics on a malformed glob like
+// regexp.MustCompile. Both match one path segment per pattern segment, only a
+// trailing catch-all "*name" spans several. Like the router, the catch-all
+// needs its slash: "/files/*rest" matches "/files/" but not "/files", and a
+// trailing slash only matches a pattern ending with one.
+func NewPathPatterns(patterns []string) PathPatterns {
+	return must(parsePathPatterns(patterns))
+}
+
+func parsePathPatterns(patterns []string) (PathPatterns, error) {
+	res := make(PathPatterns, len(patterns))
+	for i, p := range patterns {
+		segs := splitPath(p)
+		for _, seg := range segs {
+			if _, err := path.Match(seg, ""); err != nil {
+				return nil, fmt.Errorf("brotli_hz: invalid path pattern %s: %w", p, err)
+			}
+		}
+		res[i] = segs
+	}
+	return res, nil
+}
+
+func (pps PathPatterns) Contains(p string) bool {
+	segs := splitPath(p)
+	for _, pattern := range pps {
+		if matchSegments(pattern, segs) {
+			return true
+		}
+	}
+	return false
+}
+
+func matchSegments(pattern, segs []string) bool {
+	for i, p := range pattern {
+		if i >= len(segs) {
+			return false
+		}
+		if i == len(pattern)-1 && isParam(p, '*') {
+			return true
+		}
+		if isParam(p, ':') {
+			if segs[i] == "" {
+				return false
+			}
+			continue
+		}
+		if ok, _ := path.Match(p, segs[i]); !ok {
+			return false
+		}
+	}
+	return len(pattern) == len(segs)
+}
+
+// isParam reports whether seg is a route parameter such as ":id" or "*rest",
+// as opposed to a glob such as "*.js".
+func isParam(seg string, prefix byte) bool {
+	if len(seg) < 2 || seg[0] != prefix {
+		return false
+	}
+	for _, r := range seg[1:] {
+		if !(r == '_' || unicode.IsLetter(r) || unicode.IsDigit(r)) {
+			return false
+		}
+	}
+	return true
+}
+
+// splitPath keeps a trailing empty segment for a trailing slash.
+func splitPath(p string) []string {
+	return strings.Split(strings.TrimPrefix(p, "/"), "/")
+}
+
+// NewMethods matches HTTP methods case-insensitively.
+func NewMethods(methods []string) Methods {
+	res := make(Methods, len(methods))
+	for _, m := range methods {
+		res[strings.ToUpper(m)] = struct{}{}
+	}
+	return res
+}
+
+func (ms Methods) Contains(method string) bool {
+	_, ok := ms[strings.ToUpper(method)]
+	return ok
+}
+
+// NewStatusCodes accepts codes such as "200", classes such as "2xx" and
+// ranges such as "200-206", it panics on anything else like regexp.MustCompile.
+func NewStatusCodes(codes []string) StatusCodes {
+	return must(parseStatusCodes(codes))
+}
+
+func parseStatusCodes(codes []string) (StatusCodes, error) {
+	res := make(StatusCodes, len(codes))
+	for i, c := range codes {
+		c = strings.ToLower(strings.TrimSpace(c))
+		var lo, hi int
+		var err error
+		if class, ok := strings.CutSuffix(c, "xx"); ok && len(class) == 1 {
+			lo, err = strconv.Atoi(class)
+			lo, hi = lo*100, lo*100+99
+		} else if from, to, ok := strings.Cut(c, "-"); ok {
+			if lo, err = strconv.Atoi(from); err == nil {
+				hi, err = strconv.Atoi(to)
+			}
+		} else {
+			lo, err = strconv.Atoi(c)
+			hi = lo
+		}
+		if err != nil || lo < 100 || hi > 599 || lo > hi {
+			return nil, fmt.Errorf("brotli_hz: invalid status code %q", codes[i])
+		}
+		res[i] = [2]int{lo, hi}
+	}
+	return res, nil
+}
+
+func (scs StatusCodes) Contains(code int) bool {
+	for _, r := range scs {
+		if r[0] <= code && code <= r[1] {
+			return true
+		}
+	}
+	return false
+}
+
+// NewRoutes accepts route templates as registered with the router, such as
+// "/users/:id", and matches them against RequestContext.FullPath.
+func NewRoutes(routes []string) Routes {
+	res := make(Routes, len(routes))
+	for _, r := range routes {
+		res[r] = struct{}{}
+	}
+	return res
+}
+
+func (rs Routes) Contains(route string) bool {
+	_, ok := rs[route]
+	return ok
+}
+
+// NewContentTypes accepts media types such as "application/json", or
+// wildcards such as "text/*".
+func NewContentTypes(types []string) ContentTypes {
+	res := make(ContentTypes, len(types))
+	for i, t := range types {
+		res[i] = strings.ToLower(strings.TrimSpace(t))
+	}
+	return res
+}
+
+func (cts ContentTypes) Contains(contentType string) bool {
+	mediaType, _, _ := strings.Cut(contentType, ";")
+	mediaType = strings.ToLower(strings.TrimSpace(mediaType))
+	for _, t := range cts {
+		if prefix, ok := strings.CutSuffix(t, "*"); ok {
+			if strings.HasPrefix(mediaType, prefix) {
+				return true
+			}
+		} else if mediaType == t {
+			return true
+		}
+	}
+	return false
+}
@@ -3,6 +3,7 @@ package brotli_hz
 import (
 	"bytes"
 	"context"
+	"errors"
 	"github.com/andybalholm/brotli"
 	"github.com/cloudwego/hertz/pkg/app/client"
 	"github.com/cloudwego/hertz/pkg/protocol"
@@ -13,10 +14,30 @@ import (
 type (
 	ClientOption  func(*ClientOptions)
 	ClientOptions struct {
-		ExcludedExtensions  ExcludedExtensions
-		ExcludedPaths       ExcludedPaths
-		ExcludedPathRegexes ExcludedPathRegexes
-		DecompressFn        client.Middleware
+		ExcludedExtensions   ExcludedExtensions
+		ExcludedPaths        ExcludedPaths
+		ExcludedPathRegexes  ExcludedPathRegexes
+		ExcludedPathPatterns PathPatterns
+		Methods              Methods
+		IncludedExtensions   IncludedExtensions
+		IncludedPaths        IncludedPaths
+		IncludedPathRegexes  IncludedPathRegexes
+		DecompressFn         client.Middleware
+		WriterOptions        *brotli.WriterOptions
+		MaxDecompressWindow  int
+		MinLength            int
+		IncludedContentTypes ContentTypes
+		ExcludedContentTypes ContentTypes
+		IdentityFallback     bool
+		MinSavingsRatio      float64
+
+		// the path rules, compiled once the options are applied
+		excludedPaths   pathPrefixes
+		excludedRegexes pathRegexes
+		includedPaths   pathPrefixes
+		includedRegexes pathRegexes
+		// err collects the invalid options, NewBrotliClient returns it
+		err error
 	}
 )
 
@@ -27,6 +48,10 @@ func newClientOptions(opts ...ClientOption) *ClientOptions {
 	for _, opt := range opts {
 		opt(options)
 	}
+	options.excludedPaths = compilePaths(options.ExcludedPaths)
+	options.excludedRegexes = compileRegexes(options.ExcludedPathRegexes)
+	options.includedPaths = compilePaths(options.IncludedPaths)
+	options.includedRegexes = compileRegexes(options.IncludedPathRegexes)
 	return options
 }
 
@@ -44,7 +69,52 @@ func WithClientExcludedPaths(paths []string) ClientOption {
 
 func WithClientExcludedPathRegexes(regexes []string) ClientOption {
 	return func(o *ClientOptions) {
-		o.ExcludedPathRegexes = NewExcludedPathRegexes(regexes)
+		var err error
+		o.ExcludedPathRegexes, err = parsePathRegexes(regexes)
+		o.err = errors.Join(o.err, err)
+	}
+}
+
+// WithClientMethods only compresses the requests with these methods.
+func WithClientMethods(methods []string) ClientOption {
+	return func(o *ClientOptions) {
+		o.Methods = NewMethods(methods)
+	}
+}
+
+// WithClientIncludedExtensions only compresses paths with these extensions,
+// excluded extensions still win.
+func WithClientIncludedExtensions(exts []string) ClientOption {
+	return func(o *ClientOptions) {
+		o.IncludedExtensions = NewIncludedExtensions(exts)
+	}
+}
+
+// WithClientIncludedPaths only compresses paths with these prefixes, or matching
+// the included regexes. Excluded paths still win.
+func WithClientIncludedPaths(paths []string) ClientOption {
+	return func(o *ClientOptions) {
+		o.IncludedPaths = NewIncludedPaths(paths)
+	}
+}
+
+// WithClientIncludedPathRegexes only compresses paths matching these regexes, or
+// the included paths. Excluded paths still win.
+func WithClientIncludedPathRegexes(regexes []string) ClientOption {
+	return func(o *ClientOptions) {
+		var err error
+		o.IncludedPathRegexes, err = parsePathRegexes(regexes)
+		o.err = errors.Join(o.err, err)
+	}
+}
+
+// WithClientExcludedPathPatterns excludes paths matching route patterns or
+// globs, see NewPathPatterns.
+func WithClientExcludedPathPatterns(patterns []string) ClientOption {
+	return func(o *ClientOptions) {
+		var err error
+		o.ExcludedPathPatterns, err = parsePathPatterns(patterns)
+		o.err = errors.Join(o.err, err)
 	}
 }
 
@@ -54,6 +124,63 @@ func WithClientDecompressFn(fn client.Middleware) ClientOption {
 	}
 }
 
+// WithClientWriterOptions configures the brotli encoder, its Quality takes
+// precedence over the level passed to BrotliClient.
+// Qualities 0 and 1 ignore LGWin and always use a 2^18 window.
+func WithClientWriterOptions(wo brotli.WriterOptions) ClientOption {
+	return func(o *ClientOptions) {
+		o.WriterOptions = &wo
+	}
+}
+
+// WithClientMaxDecompressWindow rejects brotli response bodies whose window
+// size (log2) is larger than lgwin before they reach DecompressFn.
+func WithClientMaxDecompressWindow(lgwin int) ClientOption {
+	return func(o *ClientOptions) {
+		o.MaxDecompressWindow = lgwin
+	}
+}
+
+// WithClientMinLength skips compression of request bodies shorter than n bytes.
+func WithClientMinLength(n int) ClientOption {
+	return func(o *ClientOptions) {
+		o.MinLength = n
+	}
+}
+
+// WithClientIncludedContentTypes restricts compression to requests of the
+// given content types.
+func WithClientIncludedContentTypes(types []string) ClientOption {
+	return func(o *ClientOptions) {
+		o.IncludedContentTypes = NewContentTypes(types)
+	}
+}
+
+func WithClientExcludedContentTypes(types []string) ClientOption {
+	return func(o *ClientOptions) {
+		o.ExcludedContentTypes = NewContentTypes(types)
+	}
+}
+
+// WithClientIdentityFallback sends the request body uncompressed unless brotli makes it
+// smaller by at least minSavingsRatio of its size, e.g. 0.1 for 10%.
+func WithClientIdentityFallback(minSavingsRatio float64) ClientOption {
+	return func(o *ClientOptions) {
+		o.IdentityFallback = true
+		o.MinSavingsRatio = minSavingsRatio
+	}
+}
+
+// WithClientPreset applies the level, window size, min length and content
+// types of p.
+func WithClientPreset(p Preset) ClientOption {
+	return func(o *ClientOptions) {
+		o.WriterOptions = &brotli.WriterOptions{Quality: p.Level, LGWin: p.LGWin}
+		o.MinLength = p.MinLength
+		o.IncludedContentTypes = NewContentTypes(p.ContentTypes)
+	}
+}
+
 func DefaultClientDecompressHandle(_ client.Endpoint) client.Endpoint {
 	return func(ctx context.Context, req *protocol.Request, resp *protocol.Response) (err error) {
 		if len(resp.Body()) <= 0 {
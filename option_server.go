@@ -1,32 +1,73 @@
 package brotli_hz
 
 import (
-	"bytes"
 	"context"
+	"errors"
 	"github.com/andybalholm/brotli"
 	"github.com/cloudwego/hertz/pkg/app"
-	"github.com/cloudwego/hertz/pkg/protocol/consts"
-	"io"
+	"time"
 )
 
 // server middleware options
 type (
 	Option  func(*Options)
 	Options struct {
-		ExcludedExtensions  ExcludedExtensions
-		ExcludedPaths       ExcludedPaths
-		ExcludedPathRegexes ExcludedPathRegexes
-		DecompressFn        app.HandlerFunc
+		ExcludedExtensions    ExcludedExtensions
+		ExcludedPaths         ExcludedPaths
+		ExcludedPathRegexes   ExcludedPathRegexes
+		ExcludedPathPatterns  PathPatterns
+		IncludedExtensions    IncludedExtensions
+		IncludedPaths         IncludedPaths
+		IncludedPathRegexes   IncludedPathRegexes
+		IncludedRoutes        Routes
+		ExcludedRoutes        Routes
+		RouteOptions          map[string][]Option
+		Methods               Methods
+		StatusCodes           StatusCodes
+		DecompressFn          app.HandlerFunc
+		Cache                 *ResponseCache
+		WriterOptions         *brotli.WriterOptions
+		MaxDecompressWindow   int
+		MinLength             int
+		IncludedContentTypes  ContentTypes
+		ExcludedContentTypes  ContentTypes
+		BufferSize            int
+		EventStream           bool
+		FlushPolicy           *FlushPolicy
+		AsyncQueueSize        int
+		Limiter               *Limiter
+		LimitPolicy           LimitPolicy
+		CompressionTimeout    time.Duration
+		IdentityFallback      bool
+		MinSavingsRatio       float64
+		Probe                 *Probe
+		SniffContentType      bool
+		SetSniffedContentType bool
+
+		// the path rules, compiled once the options are applied
+		excludedPaths   pathPrefixes
+		excludedRegexes pathRegexes
+		includedPaths   pathPrefixes
+		includedRegexes pathRegexes
+		// decompressAll passes every coding to DecompressFn, not only br
+		decompressAll bool
+		// err collects the invalid options, NewBrotli returns it
+		err error
 	}
 )
 
 func newOptions(opts ...Option) *Options {
 	options := &Options{
 		ExcludedExtensions: NewExcludedExtensions([]string{".png", ".gif", ".jpeg", ".jpg"}),
+		BufferSize:         64 * 1024,
 	}
 	for _, opt := range opts {
 		opt(options)
 	}
+	options.excludedPaths = compilePaths(options.ExcludedPaths)
+	options.excludedRegexes = compileRegexes(options.ExcludedPathRegexes)
+	options.includedPaths = compilePaths(options.IncludedPaths)
+	options.includedRegexes = compileRegexes(options.IncludedPathRegexes)
 	return options
 }
 
@@ -44,27 +85,256 @@ func WithExcludedPaths(paths []string) Option {
 
 func WithExcludedPathRegexes(regexes []string) Option {
 	return func(o *Options) {
-		o.ExcludedPathRegexes = NewExcludedPathRegexes(regexes)
+		var err error
+		o.ExcludedPathRegexes, err = parsePathRegexes(regexes)
+		o.err = errors.Join(o.err, err)
+	}
+}
+
+// WithMethods only compresses the responses to requests with these methods.
+func WithMethods(methods []string) Option {
+	return func(o *Options) {
+		o.Methods = NewMethods(methods)
+	}
+}
+
+// WithStatusCodes only compresses responses with these status codes, e.g.
+// "2xx", "404" or "200-206", see NewStatusCodes.
+func WithStatusCodes(codes []string) Option {
+	return func(o *Options) {
+		var err error
+		o.StatusCodes, err = parseStatusCodes(codes)
+		o.err = errors.Join(o.err, err)
 	}
 }
 
+// WithIncludedRoutes only compresses the responses of these routes, given as
+// registered with the router, e.g. "/users/:id".
+func WithIncludedRoutes(routes []string) Option {
+	return func(o *Options) {
+		o.IncludedRoutes = NewRoutes(routes)
+	}
+}
+
+// WithExcludedRoutes never compresses the responses of these routes, given as
+// registered with the router, e.g. "/users/:id".
+func WithExcludedRoutes(routes []string) Option {
+	return func(o *Options) {
+		o.ExcludedRoutes = NewRoutes(routes)
+	}
+}
+
+// WithRouteOptions applies opts on top of the other options for requests
+// matching route, e.g. a higher level for "/assets/*filepath".
+func WithRouteOptions(route string, opts ...Option) Option {
+	return func(o *Options) {
+		if o.RouteOptions == nil {
+			o.RouteOptions = make(map[string][]Option)
+		}
+		o.RouteOptions[route] = append(o.RouteOptions[route], opts...)
+	}
+}
+
+// WithIncludedExtensions only compresses paths with these extensions,
+// excluded extensions still win.
+func WithIncludedExtensions(exts []string) Option {
+	return func(o *Options) {
+		o.IncludedExtensions = NewIncludedExtensions(exts)
+	}
+}
+
+// WithIncludedPaths only compresses paths with these prefixes, or matching
+// the included regexes. Excluded paths still win.
+func WithIncludedPaths(paths []string) Option {
+	return func(o *Options) {
+		o.IncludedPaths = NewIncludedPaths(paths)
+	}
+}
+
+// WithIncludedPathRegexes only compresses paths matching these regexes, or
+// the included paths. Excluded paths still win.
+func WithIncludedPathRegexes(regexes []string) Option {
+	return func(o *Options) {
+		var err error
+		o.IncludedPathRegexes, err = parsePathRegexes(regexes)
+		o.err = errors.Join(o.err, err)
+	}
+}
+
+// WithExcludedPathPatterns excludes paths matching route patterns or globs,
+// see NewPathPatterns.
+func WithExcludedPathPatterns(patterns []string) Option {
+	return func(o *Options) {
+		var err error
+		o.ExcludedPathPatterns, err = parsePathPatterns(patterns)
+		o.err = errors.Join(o.err, err)
+	}
+}
+
+// WithDecompressFn decodes br request bodies with fn before the handler runs,
+// see WithDecompress for the other codings.
 func WithDecompressFn(fn app.HandlerFunc) Option {
 	return func(o *Options) {
 		o.DecompressFn = fn
+		o.decompressAll = false
+	}
+}
+
+// WithDecompress decodes the request bodies of every coding like Decompress
+// before the handler runs, unsupported codings get 415.
+func WithDecompress(opts ...DecompressOption) Option {
+	return func(o *Options) {
+		fn, err := NewDecompress(opts...)
+		o.err = errors.Join(o.err, err)
+		o.DecompressFn = fn
+		o.decompressAll = true
 	}
 }
 
-func DefaultDecompressHandle(_ context.Context, c *app.RequestContext) {
-	if len(c.Request.Body()) <= 0 {
-		return
+// WithCache enables caching of the compressed response bodies, keyed by
+// the ETag response header or, if absent, by a hash of the body.
+func WithCache(cache *ResponseCache) Option {
+	return func(o *Options) {
+		o.Cache = cache
 	}
-	r := brotli.NewReader(bytes.NewReader(c.Request.Body()))
-	data, err := io.ReadAll(r)
-	if err != nil {
-		_ = c.AbortWithError(consts.StatusBadRequest, err)
-		return
+}
+
+// WithWriterOptions configures the brotli encoder, its Quality takes precedence
+// over the level passed to Brotli or BrotliStream.
+// Qualities 0 and 1 ignore LGWin and always use a 2^18 window.
+func WithWriterOptions(wo brotli.WriterOptions) Option {
+	return func(o *Options) {
+		o.WriterOptions = &wo
 	}
-	c.Request.Header.DelBytes([]byte("Content-Encoding"))
-	c.Request.Header.DelBytes([]byte("Content-Length"))
-	c.Request.SetBody(data)
+}
+
+// WithMaxDecompressWindow rejects brotli request bodies whose window size
+// (log2) is larger than lgwin before they reach DecompressFn.
+func WithMaxDecompressWindow(lgwin int) Option {
+	return func(o *Options) {
+		o.MaxDecompressWindow = lgwin
+	}
+}
+
+// WithMinLength skips compression of response bodies shorter than n bytes.
+func WithMinLength(n int) Option {
+	return func(o *Options) {
+		o.MinLength = n
+	}
+}
+
+// WithIncludedContentTypes restricts compression to responses of the given
+// content types.
+func WithIncludedContentTypes(types []string) Option {
+	return func(o *Options) {
+		o.IncludedContentTypes = NewContentTypes(types)
+	}
+}
+
+func WithExcludedContentTypes(types []string) Option {
+	return func(o *Options) {
+		o.ExcludedContentTypes = NewContentTypes(types)
+	}
+}
+
+// WithBufferSize sets how many bytes BrotliAuto buffers before it switches
+// from a Content-Length response to chunked streaming.
+func WithBufferSize(n int) Option {
+	return func(o *Options) {
+		o.BufferSize = n
+	}
+}
+
+// WithEventStream lets BrotliStream and BrotliAuto compress text/event-stream
+// responses as a single brotli stream, which is flushed at the end of every event.
+func WithEventStream(enable bool) Option {
+	return func(o *Options) {
+		o.EventStream = enable
+	}
+}
+
+// WithFlushPolicy makes BrotliStream and BrotliAuto flush the response without
+// waiting for the handler to call Flush. The response is then compressed as a
+// single brotli stream.
+func WithFlushPolicy(policy FlushPolicy) Option {
+	return func(o *Options) {
+		o.FlushPolicy = &policy
+	}
+}
+
+// WithAsyncCompression makes BrotliStream and BrotliAuto compress streamed
+// responses on a dedicated goroutine, with up to size writes and flushes
+// queued whatever their size. Errors are returned by the next Write or Flush
+// of the handler.
+func WithAsyncCompression(size int) Option {
+	return func(o *Options) {
+		o.AsyncQueueSize = size
+	}
+}
+
+// WithLimiter makes Brotli, BrotliStream and BrotliAuto reserve budget from l
+// for every encoder, policy decides what to do without budget. Streamed
+// responses reserve it at their first write and release it once finalized.
+func WithLimiter(l *Limiter, policy LimitPolicy) Option {
+	return func(o *Options) {
+		o.Limiter = l
+		o.LimitPolicy = policy
+	}
+}
+
+// WithCompressionTimeout bounds the time spent compressing a buffered body,
+// together with the deadline of the request context. A body which is not
+// compressed in time is sent uncompressed. The deadline is checked every 4KB
+// of input, so compression may overrun it by the time one such slice takes.
+// Cancellation of the request context, e.g. with
+// server.WithSenseClientDisconnection, also stops body stream encoders.
+func WithCompressionTimeout(d time.Duration) Option {
+	return func(o *Options) {
+		o.CompressionTimeout = d
+	}
+}
+
+// WithIdentityFallback sends the response body uncompressed unless brotli makes it
+// smaller by at least minSavingsRatio of its size, e.g. 0.1 for 10%.
+func WithIdentityFallback(minSavingsRatio float64) Option {
+	return func(o *Options) {
+		o.IdentityFallback = true
+		o.MinSavingsRatio = minSavingsRatio
+	}
+}
+
+// WithProbe samples buffered responses with a missing or
+// application/octet-stream Content-Type and skips the ones which won't compress.
+func WithProbe(p Probe) Option {
+	return func(o *Options) {
+		o.Probe = &p
+	}
+}
+
+// WithContentTypeSniffing detects the Content-Type of responses which have
+// none from the start of the body, like http.DetectContentType, before the
+// content type rules are applied. setHeader also sets it on the response.
+func WithContentTypeSniffing(setHeader bool) Option {
+	return func(o *Options) {
+		o.SniffContentType = true
+		o.SetSniffedContentType = setHeader
+	}
+}
+
+// WithPreset applies the level, window size, min length and content types of p.
+func WithPreset(p Preset) Option {
+	return func(o *Options) {
+		o.WriterOptions = &brotli.WriterOptions{Quality: p.Level, LGWin: p.LGWin}
+		o.MinLength = p.MinLength
+		o.IncludedContentTypes = NewContentTypes(p.ContentTypes)
+	}
+}
+
+var defaultDecompress = Decompress()
+
+// DefaultDecompressHandle decodes the request body like Decompress with its
+// default options, unsupported codings get 415. Passed to WithDecompressFn it
+// only sees br bodies, use WithDecompress for the others.
+func DefaultDecompressHandle(ctx context.Context, c *app.RequestContext) {
+	defaultDecompress(ctx, c)
 }
@@ -0,0 +1,65 @@
+package brotli_hz
+
+import (
+	"bytes"
+	"github.com/cloudwego/hertz/pkg/protocol"
+	"math"
+)
+
+// Probe samples responses without a known Content-Type and skips compressing
+// the ones which look random, such as encrypted or already compressed blobs.
+type Probe struct {
+	// SampleSize is how many leading bytes are sampled, 4KB if zero.
+	SampleSize int
+	// MaxEntropy is the Shannon entropy in bits per byte above which the body
+	// is not compressed, 7.5 if zero. Random data is close to 8.
+	MaxEntropy float64
+}
+
+func (p Probe) compressible(body []byte) bool {
+	size := p.SampleSize
+	if size <= 0 {
+		size = 4 * 1024
+	}
+	maxEntropy := p.MaxEntropy
+	if maxEntropy <= 0 {
+		maxEntropy = 7.5
+	}
+	return entropy(body[:min(len(body), size)]) <= maxEntropy
+}
+
+// entropy returns the Shannon entropy of p in bits per byte.
+func entropy(p []byte) float64 {
+	if len(p) == 0 {
+		return 0
+	}
+	var counts [256]int
+	for _, b := range p {
+		counts[b]++
+	}
+	var e float64
+	n := float64(len(p))
+	for _, c := range counts {
+		if c > 0 {
+			f := float64(c) / n
+			e -= f * math.Log2(f)
+		}
+	}
+	return e
+}
+
+// responseContentType returns the Content-Type set on resp, without the
+// default hertz reports for responses which have none.
+func responseContentType(resp *protocol.Response) []byte {
+	noDefault := resp.Header.NoDefaultContentType()
+	resp.Header.SetNoDefaultContentType(true)
+	contentType := resp.Header.ContentType()
+	resp.Header.SetNoDefaultContentType(noDefault)
+	return contentType
+}
+
+// unknownContentType reports whether resp carries no usable Content-Type.
+func unknownContentType(resp *protocol.Response) bool {
+	contentType := responseContentType(resp)
+	return len(contentType) == 0 || bytes.HasPrefix(contentType, []byte("application/octet-stream"))
+}